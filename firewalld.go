@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/shu-go/rng"
+	"github.com/shu-go/wfw/wfw"
+)
+
+// fwZone is a zone of firewalld.
+type fwZone struct {
+	XMLName     xml.Name `xml:"zone"`
+	Short       string   `xml:"short"`
+	Description string   `xml:"description"`
+	Rules       []fwRule `xml:"rule"`
+}
+
+// fwRule is a rich rule of firewalld.
+type fwRule struct {
+	Comment string `xml:",comment"`
+
+	Family      string  `xml:"family,attr"`
+	Source      *fwAddr `xml:"source"`
+	Destination *fwAddr `xml:"destination"`
+
+	// at most one of them
+	Port       *fwPort     `xml:"port"`
+	SourcePort *fwPort     `xml:"source-port"`
+	Protocol   *fwProtocol `xml:"protocol"`
+
+	Accept *struct{} `xml:"accept"`
+	Drop   *struct{} `xml:"drop"`
+}
+
+type fwAddr struct {
+	Address string `xml:"address,attr"`
+}
+
+type fwPort struct {
+	Port     string `xml:"port,attr"`
+	Protocol string `xml:"protocol,attr"`
+}
+
+type fwProtocol struct {
+	Value string `xml:"value,attr"`
+}
+
+// String returns r in the rich language of firewall-cmd --add-rich-rule.
+func (r fwRule) String() string {
+	s := fmt.Sprintf("rule family=%q", r.Family)
+	if r.Source != nil {
+		s += fmt.Sprintf(" source address=%q", r.Source.Address)
+	}
+	if r.Destination != nil {
+		s += fmt.Sprintf(" destination address=%q", r.Destination.Address)
+	}
+	if r.Port != nil {
+		s += fmt.Sprintf(" port port=%q protocol=%q", r.Port.Port, r.Port.Protocol)
+	}
+	if r.SourcePort != nil {
+		s += fmt.Sprintf(" source-port port=%q protocol=%q", r.SourcePort.Port, r.SourcePort.Protocol)
+	}
+	if r.Protocol != nil {
+		s += fmt.Sprintf(" protocol value=%q", r.Protocol.Value)
+	}
+	if r.Accept != nil {
+		s += " accept"
+	} else {
+		s += " drop"
+	}
+	return s
+}
+
+// firewalldRules returns the rich rules of the inbound rules of rs.
+// Addresses are expanded into CIDR prefixes, as rich rules take no ranges.
+// It also returns the number of the outbound rules, which zones cannot have.
+func firewalldRules(rs wfw.RuleSet) ([]fwRule, int, error) {
+	var rules []fwRule
+	outbound := 0
+	for _, r := range rs {
+		if r.Direction == "out" {
+			outbound++
+			continue
+		}
+
+		base := fwRule{
+			Comment: " " + strings.ReplaceAll(r.Name, "--", "- -") + " ",
+			Family:  "ipv4",
+		}
+		if wfw.Family(r.IP.Start) == 6 {
+			base.Family = "ipv6"
+		}
+		if r.Allow {
+			base.Accept = &struct{}{}
+		} else {
+			base.Drop = &struct{}{}
+		}
+
+		protocol := strings.ToLower(r.Protocol)
+		switch protocol {
+		case "any":
+		case "icmpv4":
+			base.Protocol = &fwProtocol{Value: "icmp"}
+		case "icmpv6":
+			base.Protocol = &fwProtocol{Value: "ipv6-icmp"}
+		case "tcp", "udp":
+			localPort, remotePort := firewalldPorts(r.Port), firewalldPorts(r.RemotePort)
+			switch {
+			case localPort != "" && remotePort != "":
+				return nil, 0, fmt.Errorf("rule %q: a rich rule cannot match both local and remote ports", r.Name)
+			case localPort != "":
+				base.Port = &fwPort{Port: localPort, Protocol: protocol}
+			case remotePort != "":
+				base.SourcePort = &fwPort{Port: remotePort, Protocol: protocol}
+			default:
+				base.Protocol = &fwProtocol{Value: protocol}
+			}
+		default:
+			base.Protocol = &fwProtocol{Value: protocol}
+		}
+
+		for _, src := range firewalldAddrs(r.IP) {
+			for _, dst := range firewalldAddrs(r.LocalIP) {
+				fr := base
+				if src != "" {
+					fr.Source = &fwAddr{Address: src}
+				}
+				if dst != "" {
+					fr.Destination = &fwAddr{Address: dst}
+				}
+				rules = append(rules, fr)
+			}
+		}
+	}
+	return rules, outbound, nil
+}
+
+// firewalldPorts returns a port range as in rich rules, or "" for any port.
+func firewalldPorts(r rng.Range) string {
+	if r.Start == nil || r.Equal(wfw.AnyPort) {
+		return ""
+	}
+	return stringifyPortRange(r)
+}
+
+// firewalldAddrs returns the CIDR prefixes of an address range, or [""] for any address.
+func firewalldAddrs(r rng.Range) []string {
+	if r.Start == nil || r.Equal(wfw.AnyIP(wfw.Family(r.Start))) {
+		return []string{""}
+	}
+
+	cidrs := cidrsFromRange(r)
+	for i := range cidrs {
+		cidrs[i] = trimHostPrefix(cidrs[i])
+	}
+	return cidrs
+}
+
+// writeFirewalldZone writes rules as the zone XML of firewalld, named zone.
+func writeFirewalldZone(w io.Writer, rules []fwRule, zone, source string) error {
+	z := fwZone{
+		Short:       zone,
+		Description: "generated by wfw from " + source,
+		Rules:       rules,
+	}
+
+	content, err := xml.MarshalIndent(z, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprint(w, xml.Header)
+	fmt.Fprintf(w, "<!-- install as /etc/firewalld/zones/%s.xml, then bind interfaces or sources to the zone -->\n", zone)
+	fmt.Fprintln(w, string(content))
+	return nil
+}
+
+// writeFirewallCmd writes rules as firewall-cmd commands replacing the rich rules of the zone with them.
+// The rich rules of an existing zone are removed, not the zone, to keep the interfaces and sources bound to it.
+func writeFirewallCmd(w io.Writer, rules []fwRule, zone, source string) {
+	fmt.Fprintf(w, "# generated by wfw from %s\n", source)
+	fmt.Fprintf(w, "firewall-cmd --permanent --new-zone=%s 2>/dev/null\n", zone)
+	fmt.Fprintf(w, "firewall-cmd --permanent --zone=%s --list-rich-rules | while IFS= read -r r; do firewall-cmd --permanent --zone=%s --remove-rich-rule=\"$r\"; done\n", zone, zone)
+	for _, r := range rules {
+		comment := strings.NewReplacer("\r", " ", "\n", " ").Replace(strings.TrimSpace(r.Comment))
+		fmt.Fprintf(w, "firewall-cmd --permanent --zone=%s --add-rich-rule='%s' # %s\n", zone, r, comment)
+	}
+	fmt.Fprintf(w, "firewall-cmd --reload\n")
+}
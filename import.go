@@ -0,0 +1,521 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/shu-go/wfw/wfw"
+)
+
+type importCmd struct {
+	From   string `cli:"from" default:"netsh" help:"{netsh,json,csv}. netsh reads the English output of 'netsh advfirewall firewall show rule name=all verbose'. json and csv read Get-NetFirewallRule with the fields of its port and address filters, exported by ConvertTo-Json or Export-Csv"`
+	Output string `cli:"output,o" help:"rule file to write. defaults to stdout"`
+}
+
+func (c importCmd) Run(args []string) error {
+	if len(args) == 0 {
+		return errors.New("an input file is needed")
+	}
+
+	var parse func(string) ([]map[string]string, error)
+	var conv recordConverter
+	switch strings.ToLower(c.From) {
+	case "netsh":
+		parse, conv = parseNetsh, ruleIFFromNetsh
+	case "json":
+		parse, conv = parsePSJSON, ruleIFFromPS
+	case "csv":
+		parse, conv = parsePSCSV, ruleIFFromPS
+	default:
+		return errors.New("--from must be netsh, json or csv")
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	text, err := readText(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	recs, err := parse(text)
+	if err != nil {
+		return err
+	}
+
+	ruleIFs, notes := importRecords(recs, conv)
+	for _, n := range notes {
+		fmt.Fprintln(os.Stderr, n)
+	}
+
+	return writeRuleIFs(ruleIFs, c.Output)
+}
+
+// writeRuleIFs writes ruleIFs as a rule file to path, or to stdout if path is empty.
+func writeRuleIFs(ruleIFs []RuleIF, path string) error {
+	content, err := json.MarshalIndent(ruleIFs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if path == "" {
+		fmt.Println(string(content))
+		return nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	file.WriteString(string(content))
+	file.Close()
+
+	return nil
+}
+
+// recordConverter converts a rule exported from Windows into a RuleIF.
+// name is the name of the rule, returned even with err.
+// keywords are addresses and ports which wfw cannot express, such as LocalSubnet.
+type recordConverter func(rec map[string]string) (rif RuleIF, name string, keywords []string, err error)
+
+// importRecords converts recs into rules of a rule file.
+//
+// As Windows Firewall lets block rules win, the block rules come first in the result.
+// Disabled rules are commented out (# in the head of the name).
+// So are rules with keywords, which are left as placeholders to be replaced by hand.
+// Rules wfw cannot express otherwise, such as of programs, are skipped.
+// Rules commented out for keywords and skipped ones are explained in notes.
+func importRecords(recs []map[string]string, conv recordConverter) (ruleIFs []RuleIF, notes []string) {
+	var blocks, allows []RuleIF
+	for _, rec := range recs {
+		rif, name, keywords, err := conv(rec)
+		if err != nil {
+			notes = append(notes, fmt.Sprintf("skipped %q: %v", name, err))
+			continue
+		}
+
+		if len(keywords) > 0 {
+			notes = append(notes, fmt.Sprintf("commented out %q: replace %s", name, strings.Join(keywords, ",")))
+			if !strings.HasPrefix(rif.Name, "#") {
+				rif.Name = "#" + rif.Name
+			}
+		}
+
+		if rif.Allow {
+			allows = append(allows, rif)
+		} else {
+			blocks = append(blocks, rif)
+		}
+	}
+
+	return append(blocks, allows...), notes
+}
+
+// readText reads r as UTF-8 or, if it starts with the BOM, UTF-16LE,
+// which PowerShell writes by redirection.
+func readText(r io.Reader) (string, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	if len(content) >= 2 && content[0] == 0xff && content[1] == 0xfe {
+		u := make([]uint16, 0, len(content)/2)
+		for i := 2; i+1 < len(content); i += 2 {
+			u = append(u, uint16(content[i])|uint16(content[i+1])<<8)
+		}
+		return string(utf16.Decode(u)), nil
+	}
+
+	return strings.TrimPrefix(string(content), "\ufeff"), nil
+}
+
+// parseNetsh parses the output of `netsh advfirewall firewall show rule name=all verbose`.
+func parseNetsh(text string) ([]map[string]string, error) {
+	var recs []map[string]string
+
+	var rec map[string]string
+	var lastKey string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "---") {
+			continue
+		}
+
+		// continued value, such as ICMP types
+		if line[0] == ' ' || line[0] == '\t' {
+			if rec != nil && lastKey != "" {
+				rec[lastKey] += "\n" + strings.TrimSpace(line)
+			}
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			// Ok. and other messages
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		if key == "Rule Name" {
+			rec = make(map[string]string)
+			recs = append(recs, rec)
+		}
+		if rec == nil {
+			continue
+		}
+		rec[key] = value
+		lastKey = key
+	}
+
+	return recs, nil
+}
+
+func ruleIFFromNetsh(rec map[string]string) (RuleIF, string, []string, error) {
+	name := rec["Rule Name"]
+
+	for _, key := range []string{"Program", "Service", "InterfaceTypes", "RemoteComputerGroup", "RemoteUserGroup", "LocalPrincipal"} {
+		if v, found := rec[key]; found && !strings.EqualFold(v, "Any") {
+			return RuleIF{}, name, nil, fmt.Errorf("%s is %s", key, v)
+		}
+	}
+	if v, found := rec["Edge traversal"]; found && !strings.EqualFold(v, "No") {
+		return RuleIF{}, name, nil, fmt.Errorf("edge traversal is %s", v)
+	}
+	if v, found := rec["Security"]; found && !strings.EqualFold(v, "NotRequired") {
+		return RuleIF{}, name, nil, fmt.Errorf("security is %s", v)
+	}
+
+	rif := RuleIF{
+		Name:  name,
+		Desc:  rec["Description"],
+		Group: rec["Grouping"],
+	}
+
+	switch strings.ToLower(rec["Action"]) {
+	case "allow":
+		rif.Allow = true
+	case "block":
+		rif.Allow = false
+	default:
+		return RuleIF{}, name, nil, fmt.Errorf("action is %s", rec["Action"])
+	}
+
+	switch strings.ToLower(rec["Direction"]) {
+	case "in":
+		rif.Direction = "in"
+	case "out":
+		rif.Direction = "out"
+	default:
+		return RuleIF{}, name, nil, fmt.Errorf("direction is %s", rec["Direction"])
+	}
+
+	profile, err := parseProfile(rec["Profiles"])
+	if err != nil {
+		return RuleIF{}, name, nil, err
+	}
+	rif.Profile = profile.String()
+
+	rif.Protocol = strings.ToLower(rec["Protocol"])
+	if i := strings.Index(rif.Protocol, "\n"); i >= 0 {
+		return RuleIF{}, name, nil, fmt.Errorf("protocol %s has types and codes", rif.Protocol[:i])
+	}
+
+	keywords, err := importPortsAndIPs(&rif, rec["LocalPort"], rec["RemoteIP"], rec["RemotePort"], rec["LocalIP"])
+	if err != nil {
+		return RuleIF{}, name, nil, err
+	}
+
+	if !strings.EqualFold(rec["Enabled"], "Yes") {
+		rif.Name = "#" + rif.Name
+	}
+
+	return rif, name, keywords, nil
+}
+
+// parsePSJSON parses the output of ConvertTo-Json, an array of rules or a rule.
+// The keys are lower-cased, and arrays such as of ports are joined with commas.
+func parsePSJSON(text string) ([]map[string]string, error) {
+	var objs []map[string]any
+	if strings.HasPrefix(strings.TrimSpace(text), "{") {
+		var obj map[string]any
+		if err := json.Unmarshal([]byte(text), &obj); err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	} else if err := json.Unmarshal([]byte(text), &objs); err != nil {
+		return nil, err
+	}
+
+	var recs []map[string]string
+	for _, obj := range objs {
+		rec := make(map[string]string)
+		for k, v := range obj {
+			rec[strings.ToLower(k)] = psString(v)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+func psString(v any) string {
+	switch v := v.(type) {
+	case nil, map[string]any:
+		return ""
+	case string:
+		return v
+	case []any:
+		var ss []string
+		for _, e := range v {
+			ss = append(ss, psString(e))
+		}
+		return strings.Join(ss, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// parsePSCSV parses the output of Export-Csv, with or without #TYPE.
+// The keys are lower-cased.
+func parsePSCSV(text string) ([]map[string]string, error) {
+	if strings.HasPrefix(text, "#TYPE") {
+		_, text, _ = strings.Cut(text, "\n")
+	}
+
+	rows, err := csv.NewReader(strings.NewReader(text)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	var recs []map[string]string
+	for _, row := range rows[1:] {
+		rec := make(map[string]string)
+		for i, v := range row {
+			if i < len(rows[0]) {
+				rec[strings.ToLower(rows[0][i])] = v
+			}
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// ruleIFFromPS converts a rule of Get-NetFirewallRule, with the fields of
+// Get-NetFirewallPortFilter and Get-NetFirewallAddressFilter.
+// The enums may be either names (Export-Csv) or numbers (ConvertTo-Json).
+func ruleIFFromPS(rec map[string]string) (RuleIF, string, []string, error) {
+	name := rec["displayname"]
+	if name == "" {
+		name = rec["name"]
+	}
+
+	for _, key := range []string{"protocol", "localport", "remoteport", "localaddress", "remoteaddress"} {
+		// Export-Csv writes the type name of an array
+		if strings.HasPrefix(rec[key], "System.") {
+			return RuleIF{}, name, nil, fmt.Errorf("%s is %s. join it by -join ','", key, rec[key])
+		}
+	}
+
+	for _, key := range []string{"program", "service", "interfacetype", "icmptype"} {
+		if v := rec[key]; v != "" && v != "0" && !strings.EqualFold(v, "Any") {
+			return RuleIF{}, name, nil, fmt.Errorf("%s is %s", key, v)
+		}
+	}
+	if v := rec["edgetraversalpolicy"]; v != "" && v != "0" && !strings.EqualFold(v, "Block") {
+		return RuleIF{}, name, nil, fmt.Errorf("edge traversal is %s", v)
+	}
+
+	rif := RuleIF{
+		Name:  name,
+		Desc:  rec["description"],
+		Group: rec["displaygroup"],
+	}
+	if rif.Group == "" {
+		rif.Group = rec["group"]
+	}
+
+	switch strings.ToLower(rec["action"]) {
+	case "allow", "2":
+		rif.Allow = true
+	case "block", "4":
+		rif.Allow = false
+	default:
+		return RuleIF{}, name, nil, fmt.Errorf("action is %s", rec["action"])
+	}
+
+	switch strings.ToLower(rec["direction"]) {
+	case "inbound", "1":
+		rif.Direction = "in"
+	case "outbound", "2":
+		rif.Direction = "out"
+	default:
+		return RuleIF{}, name, nil, fmt.Errorf("direction is %s", rec["direction"])
+	}
+
+	// the bits of the number are the same as wfw.Profile
+	if n, err := strconv.Atoi(rec["profile"]); err == nil {
+		rif.Profile = wfw.Profile(n).String()
+	} else {
+		profile, err := parseProfile(rec["profile"])
+		if err != nil {
+			return RuleIF{}, name, nil, err
+		}
+		rif.Profile = profile.String()
+	}
+
+	rif.Protocol = strings.ToLower(rec["protocol"])
+	if rif.Protocol == "" {
+		rif.Protocol = "any"
+	}
+
+	keywords, err := importPortsAndIPs(&rif, rec["localport"], rec["remoteaddress"], rec["remoteport"], rec["localaddress"])
+	if err != nil {
+		return RuleIF{}, name, nil, err
+	}
+
+	switch strings.ToLower(rec["enabled"]) {
+	case "", "true", "1":
+	default:
+		rif.Name = "#" + rif.Name
+	}
+
+	return rif, name, keywords, nil
+}
+
+// importPortsAndIPs sets the ports and IPs of rif from comma-separated lists exported from Windows.
+// It returns the keywords in them, such as LocalSubnet and RPC.
+func importPortsAndIPs(rif *RuleIF, localPort, remoteIP, remotePort, localIP string) ([]string, error) {
+	var keywords, kw []string
+	var err error
+
+	if rif.Ports, kw, err = importPorts(localPort, "0-65535"); err != nil {
+		return nil, err
+	}
+	keywords = append(keywords, kw...)
+
+	if rif.RemotePorts, kw, err = importPorts(remotePort, ""); err != nil {
+		return nil, err
+	}
+	keywords = append(keywords, kw...)
+
+	if rif.IPs, kw, err = importIPs(remoteIP, "0.0.0.0/0,::/0"); err != nil {
+		return nil, err
+	}
+	keywords = append(keywords, kw...)
+
+	if rif.LocalIPs, kw, err = importIPs(localIP, ""); err != nil {
+		return nil, err
+	}
+	keywords = append(keywords, kw...)
+
+	return keywords, nil
+}
+
+// importPorts converts exported ports, returning anyValue for Any.
+func importPorts(s, anyValue string) (string, []string, error) {
+	if isAnyExported(s) {
+		return anyValue, nil, nil
+	}
+
+	var ports, keywords []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+
+		if isKeyword(p) {
+			keywords = append(keywords, p)
+			ports = append(ports, p)
+			continue
+		}
+
+		for _, pp := range strings.Split(p, "-") {
+			if _, err := strconv.Atoi(strings.TrimSpace(pp)); err != nil {
+				return "", nil, fmt.Errorf("port %s", p)
+			}
+		}
+		ports = append(ports, p)
+	}
+	return strings.Join(ports, ","), keywords, nil
+}
+
+// importIPs converts exported addresses, returning anyValue for Any.
+// Subnets may be with masks, such as 10.0.0.0/255.0.0.0.
+func importIPs(s, anyValue string) (string, []string, error) {
+	if isAnyExported(s) {
+		return anyValue, nil, nil
+	}
+
+	var ips, keywords []string
+	for _, ip := range strings.Split(s, ",") {
+		ip = strings.TrimSpace(ip)
+
+		if isKeyword(ip) {
+			keywords = append(keywords, ip)
+			ips = append(ips, ip)
+			continue
+		}
+
+		if addr, mask, found := strings.Cut(ip, "/"); found && strings.Contains(mask, ".") {
+			bits, ok := maskBits(mask)
+			if !ok {
+				return "", nil, fmt.Errorf("IP %s", ip)
+			}
+			ip = addr + "/" + strconv.Itoa(bits)
+		}
+
+		if _, err := parseIPRange(ip); err != nil {
+			return "", nil, fmt.Errorf("IP %s", ip)
+		}
+		ips = append(ips, ip)
+	}
+	return strings.Join(ips, ","), keywords, nil
+}
+
+func isAnyExported(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.EqualFold(s, "Any")
+}
+
+// isKeyword reports whether s is a keyword such as LocalSubnet, DefaultGateway or RPC-EPMap.
+func isKeyword(s string) bool {
+	if s == "" || !unicode.IsLetter(rune(s[0])) {
+		return false
+	}
+	for _, c := range s {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// maskBits returns the prefix length of a subnet mask such as 255.255.255.0.
+func maskBits(mask string) (int, bool) {
+	m, err := netip.ParseAddr(mask)
+	if err != nil {
+		return 0, false
+	}
+
+	ones := 0
+	for _, b := range m.AsSlice() {
+		ones += bits.LeadingZeros8(^b)
+	}
+	if netip.PrefixFrom(m, ones).Masked().Addr() != m {
+		return 0, false
+	}
+	return ones, true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/shu-go/rng"
+	"github.com/shu-go/wfw/wfw"
+)
+
+// hostRules expands ruleIFs into rules with one range in each field, applying in profile,
+// for platforms without the profiles of Windows Firewall.
+//
+// The generated rules do not overlap each other, but for allow rules of protocol any,
+// which may overlap blocks of the other protocols, as Windows Firewall lets blocks win.
+// So the blocks come first (see blocksFirst), and the first matching rule decides on any platform.
+func hostRules(ruleIFs []RuleIF, profile wfw.Profile) (wfw.RuleSet, error) {
+	var rs wfw.RuleSet
+	for _, i := range blocksFirst(ruleIFs) {
+		expanded, err := ruleIFToRuleSet(ruleIFs[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range expanded {
+			if r.Profile.Contains(profile) {
+				rs = append(rs, r)
+			}
+		}
+	}
+	return rs, nil
+}
+
+// blocksFirst returns the indices of ruleIFs, of the block rules first and in the same order otherwise,
+// so that the first matching rule decides as Windows Firewall does.
+func blocksFirst(ruleIFs []RuleIF) []int {
+	idx := make([]int, 0, len(ruleIFs))
+	for _, allow := range []bool{false, true} {
+		for i, rif := range ruleIFs {
+			if rif.Allow == allow {
+				idx = append(idx, i)
+			}
+		}
+	}
+	return idx
+}
+
+// countFamily returns the number of rules of rs of the address family.
+func countFamily(rs wfw.RuleSet, family int) int {
+	n := 0
+	for _, r := range rs {
+		if wfw.Family(r.IP.Start) == family {
+			n++
+		}
+	}
+	return n
+}
+
+// writeIPTables writes the rules of rs of the address family as an iptables-restore file,
+// into the chains <chain>-in and <chain>-out, which are flushed.
+// rs are in the order of hostRules.
+func writeIPTables(w io.Writer, rs wfw.RuleSet, family int, chain, source string) {
+	command := "iptables"
+	if family == 6 {
+		command = "ip6tables"
+	}
+
+	fmt.Fprintf(w, "# generated by wfw from %s\n", source)
+	fmt.Fprintf(w, "# apply: %s-restore --noflush < this file\n", command)
+	fmt.Fprintf(w, "# once: %[1]s -A INPUT -j %[2]s-in; %[1]s -A OUTPUT -j %[2]s-out\n", command, chain)
+	fmt.Fprintf(w, "# packets no rule matches return to INPUT or OUTPUT\n")
+	fmt.Fprintf(w, "*filter\n")
+	fmt.Fprintf(w, ":%s-in - [0:0]\n", chain)
+	fmt.Fprintf(w, ":%s-out - [0:0]\n", chain)
+
+	for _, r := range rs {
+		if wfw.Family(r.IP.Start) != family {
+			continue
+		}
+
+		args := []string{"-A", chain + "-" + r.Direction}
+
+		protocol := strings.ToLower(r.Protocol)
+		switch protocol {
+		case "any":
+			protocol = ""
+		case "icmpv4":
+			protocol = "icmp"
+		}
+		if protocol != "" {
+			args = append(args, "-p", protocol)
+		}
+
+		// remote and local in terms of iptables
+		remote, local := "s", "d"
+		if r.Direction == "out" {
+			remote, local = "d", "s"
+		}
+
+		if protocol == "tcp" || protocol == "udp" {
+			if p := iptablesPorts(r.Port); p != "" {
+				args = append(args, "--"+local+"port", p)
+			}
+			if p := iptablesPorts(r.RemotePort); p != "" {
+				args = append(args, "--"+remote+"port", p)
+			}
+		}
+
+		if a := iptablesAddr(r.IP, remote); a != "" {
+			args = append(args, a)
+		}
+		if a := iptablesAddr(r.LocalIP, local); a != "" {
+			args = append(args, a)
+		}
+
+		// a comment is up to 256 bytes, with the terminating null
+		args = append(args, "-m", "comment", "--comment", commentQuote(r.Name, 255))
+
+		if r.Allow {
+			args = append(args, "-j", "ACCEPT")
+		} else {
+			args = append(args, "-j", "DROP")
+		}
+
+		fmt.Fprintln(w, strings.Join(args, " "))
+	}
+
+	fmt.Fprintf(w, "COMMIT\n")
+}
+
+// iptablesPorts returns a port range as in --dport, or "" for any port.
+func iptablesPorts(r rng.Range) string {
+	if r.Start == nil || r.Equal(wfw.AnyPort) {
+		return ""
+	}
+	if r.Start.Equal(r.End) {
+		return StringifySeq(r.Start)
+	}
+	return StringifySeq(r.Start) + ":" + StringifySeq(r.End)
+}
+
+// iptablesAddr returns the match of an address range as the source (s) or the destination (d),
+// or "" for any address.
+func iptablesAddr(r rng.Range, sd string) string {
+	if r.Start == nil || r.Equal(wfw.AnyIP(wfw.Family(r.Start))) {
+		return ""
+	}
+	if r.Start.Equal(r.End) {
+		return "-" + sd + " " + StringifySeq(r.Start)
+	}
+	if cidrs := cidrsFromRange(r); len(cidrs) == 1 {
+		return "-" + sd + " " + cidrs[0]
+	}
+
+	dir := "src"
+	if sd == "d" {
+		dir = "dst"
+	}
+	return "-m iprange --" + dir + "-range " + StringifySeq(r.Start) + "-" + StringifySeq(r.End)
+}
+
+// commentQuote quotes s as a comment of up to max bytes,
+// for iptables-restore, nft and pf, which do not escape quotes.
+func commentQuote(s string, max int) string {
+	s = strings.NewReplacer("\"", "'", "\r", " ", "\n", " ").Replace(s)
+	if len(s) > max {
+		s = strings.ToValidUTF8(s[:max], "")
+	}
+	return "\"" + s + "\""
+}
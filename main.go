@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -33,27 +36,946 @@ type globalCmd struct {
 
 	Aggregation string `cli:"aggregation,a"  default:"ip"  help:"aggregates by [ip,port] first"`
 
-	Format  string `cli:"format,f" help:"{list,json,cmd,svg}" default:"list"`
-	Enabled bool   `cli:"enabled" help:"if --format=cmd" default:"no"`
+	Format  string `cli:"format,f" help:"{list,json,cmd,powershell,svg,iptables,ip6tables,nft,pf,firewalld,firewall-cmd,aws-sg,terraform}" default:"list"`
+	Enabled bool   `cli:"enabled" help:"if --format=cmd,powershell" default:"no"`
 
 	SVGDir        string `cli:"svg-dir,sd" default:"." help:"svg output dir"`
-	SVGNameFormat string `cli:"svg-name-format,sf" default:"%_{aggregation}_{protocol}.svg" help:"a name format for files in --svg-dir. % is the name of a rule"`
+	SVGNameFormat string `cli:"svg-name-format,sf" default:"%_{aggregation}_{protocol}.svg" help:"a name format for files in --svg-dir. % is the name of a rule. without {direction}, _out is added for outbound rules"`
+
+	Group string `cli:"group" help:"the group of rules without Group. defaults to the name of the input file. if --format=cmd, groups are set only with --replace"`
 
 	Except string `cli:"except" default:"(Except: %)" help:"suffix of the name, explaining causes of splitting rules"`
 
-	Gen genCmd `help:"generates an example rule file"`
+	Replace string `cli:"replace" help:"if --format=cmd,powershell, prefixes the names with this and deletes the rules named so before adding. applying the output twice results in the same rules"`
+
+	ID string `cli:"id" help:"suffix of the name, identifying the rule by a hash of its source rule and its ports and IPs. % is replaced with the ID, e.g. ' #%'"`
+
+	IPStyle string `cli:"ip-style" default:"range" help:"{range,cidr}. cidr expresses IPs as minimal lists of CIDR prefixes"`
+
+	Model string `cli:"model" default:"first-match" help:"{first-match,last-match,block-wins}. how the input rules decide packets. the output always decides as Windows Firewall does, block-wins"`
+
+	FillGaps bool `cli:"fill-gaps" help:"adds rules of the Defaults of the rule file for packets no rule matches"`
+
+	HostProfile string `cli:"host-profile" default:"public" help:"if --format=iptables,ip6tables,nft,pf,firewalld,firewall-cmd,aws-sg,terraform, the profile whose rules are output, as the platform has no profiles"`
+	Chain       string `cli:"chain" default:"wfw" help:"if --format=iptables,ip6tables,nft,pf,firewalld,firewall-cmd,terraform, the name of the chains, followed by -in and -out, of the nft table, of the pf anchor, of the firewalld zone, and the prefix of the terraform names"`
+
+	Gen    genCmd    `help:"generates an example rule file"`
+	Verify verifyCmd `help:"verifies that the output decides every packet as the first matching rule of the input does"`
+	Query  queryCmd  `help:"shows what happens to a packet, and which rules decide it"`
+	Lint   lintCmd   `help:"reports rules shadowed by, or redundant with, earlier rules"`
+	Diff   diffCmd   `help:"shows packets whose decisions change between two rule files, including their Defaults"`
+	Import importCmd `help:"converts rules dumped from Windows into a rule file"`
+	Gaps   gapsCmd   `help:"shows packets no rule matches, and what the Defaults of the rule file do to them"`
+}
+
+// RuleFileIF is a rule file with the default actions.
+// A rule file can also be an array of rules, without defaults.
+type RuleFileIF struct {
+	Defaults []DefaultIF `json:",omitempty"`
+	Rules    []RuleIF
+}
+
+// DefaultIF is the action on packets of a direction and a protocol which no rule matches.
+type DefaultIF struct {
+	Direction string // in (default) or out
+	Protocol  string
+	Allow     bool
+}
+
+type RuleIF struct {
+	Name, Desc string
+	Group      string `json:",omitempty"` // --group (default)
+	Allow      bool
+	Direction  string // in (default) or out
+	Profile    string // any (default) or a list of domain, private and public
+	Protocol   string
+	Ports      string `json:"Port"`
+	IPs        string `json:"IP"`
+
+	// empty means any
+	RemotePorts string `json:"RemotePort,omitempty"`
+	LocalIPs    string `json:"LocalIP,omitempty"`
+
+	tag    int
+	source int // index of the rule in the input this is generated from
+}
+
+func (c globalCmd) Run(args []string) error {
+	if c.Input == "" {
+		if len(args) == 0 {
+			return errors.New("--input is empty")
+		}
+		c.Input = args[0]
+	}
+
+	if err := c.normalize(); err != nil {
+		return err
+	}
+
+	c.Format = strings.ToLower(c.Format)
+	switch c.Format {
+	case "list", "json", "cmd", "powershell", "svg", "iptables", "ip6tables", "nft", "pf", "firewalld", "firewall-cmd", "aws-sg", "terraform":
+	default:
+		return errors.New("--format must be list,json,cmd,powershell,svg,iptables,ip6tables,nft,pf,firewalld,firewall-cmd,aws-sg or terraform")
+	}
+
+	// wildcards would delete other rules, and the others break quoting in a batch file
+	if strings.ContainsAny(c.Replace, "*?[]\"%") {
+		return errors.New("--replace must not contain any of *?[]\"%")
+	}
+
+	file, err := loadRuleFile(c.Input)
+	if err != nil {
+		return err
+	}
+
+	ruleIFs, _, err := c.generate(file.Rules, file.Defaults)
+	if err != nil {
+		return err
+	}
+
+	if c.Format == "json" {
+		content, err := json.MarshalIndent(ruleIFs, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(content))
+
+		return nil
+	}
+
+	if c.Format == "svg" {
+		name := c.Input
+		if ext := filepath.Ext(name); ext != "" {
+			name = name[:len(name)-len(ext)]
+		}
+		err := saveAsSVG(ruleIFs, name, c.SVGDir, c.SVGNameFormat, c.Aggregation)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if c.Format == "iptables" || c.Format == "ip6tables" {
+		rs, err := hostRules(ruleIFs, c.hostProfile())
+		if err != nil {
+			return err
+		}
+
+		family, other, otherFormat := 4, 6, "ip6tables"
+		if c.Format == "ip6tables" {
+			family, other, otherFormat = 6, 4, "iptables"
+		}
+		writeIPTables(os.Stdout, rs, family, c.Chain, c.Input)
+		if n := countFamily(rs, other); n > 0 {
+			fmt.Fprintf(os.Stderr, "%d IPv%d rules are left out. use --format %s\n", n, other, otherFormat)
+		}
+		return nil
+	}
+
+	if c.Format == "nft" {
+		return writeNft(os.Stdout, ruleIFs, c.hostProfile(), c.Chain, c.Input)
+	}
+
+	if c.Format == "pf" {
+		return writePF(os.Stdout, ruleIFs, c.hostProfile(), c.Chain, c.Input)
+	}
+
+	if c.Format == "firewalld" || c.Format == "firewall-cmd" {
+		rs, err := hostRules(ruleIFs, c.hostProfile())
+		if err != nil {
+			return err
+		}
+
+		rules, outbound, err := firewalldRules(rs)
+		if err != nil {
+			return err
+		}
+		if c.Format == "firewalld" {
+			err = writeFirewalldZone(os.Stdout, rules, c.Chain, c.Input)
+		} else {
+			writeFirewallCmd(os.Stdout, rules, c.Chain, c.Input)
+		}
+		if outbound > 0 {
+			fmt.Fprintf(os.Stderr, "%d outbound rules are left out, as zones of firewalld filter inbound packets only\n", outbound)
+		}
+		return err
+	}
+
+	if c.Format == "aws-sg" || c.Format == "terraform" {
+		rs, err := hostRules(ruleIFs, c.hostProfile())
+		if err != nil {
+			return err
+		}
+
+		rules, notes, err := sgRules(rs)
+		if err != nil {
+			return err
+		}
+		if c.Format == "aws-sg" {
+			err = writeAWSSG(os.Stdout, rules)
+		} else {
+			writeTerraform(os.Stdout, rules, c.Chain, c.Input)
+		}
+		for _, n := range notes {
+			fmt.Fprintln(os.Stderr, n)
+		}
+		return err
+	}
+
+	// c.Format is "cmd", "powershell" or "list"
+
+	if c.Format == "cmd" && c.Replace == "" {
+		fmt.Fprintln(os.Stderr, "groups are not set, as netsh cannot set them. use --replace, or --format powershell")
+	}
+
+	return c.writeRules(os.Stdout, ruleIFs)
+}
+
+// writeRules writes ruleIFs in c.Format, which is "cmd", "powershell" or "list".
+func (c globalCmd) writeRules(w io.Writer, ruleIFs []RuleIF) error {
+	newline, err := regexp.Compile(`\r\n|\r|\n`)
+	if err != nil {
+		return err
+	}
+
+	if c.Replace != "" && (c.Format == "cmd" || c.Format == "powershell") {
+		prefix := c.Replace + ": "
+
+		// delete the rules added by the previous run
+		remove := "Get-NetFirewallRule -DisplayName " + psQuote(prefix+"*") + " -ErrorAction SilentlyContinue | Remove-NetFirewallRule"
+		if c.Format == "cmd" {
+			fmt.Fprintf(w, "powershell -NoProfile -Command \"%s\"\r\n", remove)
+		} else {
+			fmt.Fprintf(w, "%s\r\n", remove)
+		}
+
+		for i := range ruleIFs {
+			ruleIFs[i].Name = prefix + ruleIFs[i].Name
+		}
+	}
+
+	for _, rif := range ruleIFs {
+		if c.Format == "cmd" {
+			var enabled string
+			if !c.Enabled {
+				enabled = "enable=no"
+			}
+
+			name := "name=\"" + newline.ReplaceAllLiteralString(rif.Name, " ") + "\""
+			action := "action="
+			if rif.Allow {
+				action += "allow"
+			} else {
+				action += "block"
+			}
+
+			var description string
+			if len(rif.Desc) != 0 {
+				description = "description=\"" + newline.ReplaceAllLiteralString(rif.Desc, " ") + "\""
+			}
+
+			remoteip := "remoteip=\"" + rif.IPs + "\""
+			localport := "localport=\"" + rif.Ports + "\""
+
+			var remoteport, localip string
+			if rif.RemotePorts != "" {
+				remoteport = "  remoteport=\"" + rif.RemotePorts + "\""
+			}
+			if rif.LocalIPs != "" {
+				localip = "  localip=\"" + rif.LocalIPs + "\""
+			}
+			protocol := "protocol=\"" + strings.ToLower(rif.Protocol) + "\""
+			dir := "dir=" + rif.Direction
+			profile := "profile=" + rif.Profile
+
+			if protocol != "protocol=\"tcp\"" && protocol != "protocol=\"udp\"" {
+				localport = ""
+				remoteport = ""
+			}
+
+			fmt.Fprintf(w,
+				"netsh advfirewall firewall add rule  %[1]s  %[2]s  %[3]s  %[8]s  %[9]s  %[4]s  %[5]s  %[6]s  %[7]s%[10]s%[11]s\r\n",
+				name,
+				enabled,
+				description,
+				action,
+				protocol,
+				localport,
+				remoteip,
+				dir,
+				profile,
+				remoteport,
+				localip,
+			)
+		} else if c.Format == "powershell" {
+			enabled := "-Enabled False"
+			if c.Enabled {
+				enabled = "-Enabled True"
+			}
+
+			name := "-DisplayName " + psQuote(newline.ReplaceAllLiteralString(rif.Name, " "))
+			action := "-Action "
+			if rif.Allow {
+				action += "Allow"
+			} else {
+				action += "Block"
+			}
+
+			var description string
+			if len(rif.Desc) != 0 {
+				description = "-Description " + psQuote(newline.ReplaceAllLiteralString(rif.Desc, " "))
+			}
+
+			direction := "-Direction Inbound"
+			if rif.Direction == "out" {
+				direction = "-Direction Outbound"
+			}
+
+			profile := "-Profile Any"
+			if rif.Profile != "any" {
+				profile = "-Profile " + psArray(rif.Profile)
+			}
+
+			remoteaddress := "-RemoteAddress " + psArray(rif.IPs)
+			localport := "-LocalPort " + psArray(rif.Ports)
+
+			var remoteport, localaddress string
+			if rif.RemotePorts != "" {
+				remoteport = "  -RemotePort " + psArray(rif.RemotePorts)
+			}
+			if rif.LocalIPs != "" {
+				localaddress = "  -LocalAddress " + psArray(rif.LocalIPs)
+			}
+			protocol := "-Protocol " + psQuote(rif.Protocol)
+
+			var group string
+			if rif.Group != "" {
+				group = "  -Group " + psQuote(rif.Group)
+			}
+
+			if !strings.EqualFold(rif.Protocol, "tcp") && !strings.EqualFold(rif.Protocol, "udp") {
+				localport = ""
+				remoteport = ""
+			}
+
+			fmt.Fprintf(w,
+				"New-NetFirewallRule  %[1]s%[12]s  %[2]s  %[3]s  %[8]s  %[9]s  %[4]s  %[5]s  %[6]s  %[7]s%[10]s%[11]s\r\n",
+				name,
+				enabled,
+				description,
+				action,
+				protocol,
+				localport,
+				remoteaddress,
+				direction,
+				profile,
+				remoteport,
+				localaddress,
+				group,
+			)
+		} else {
+			var action string
+			if rif.Allow {
+				action = "allow"
+			} else {
+				action = "BLOCK"
+			}
+			fmt.Fprintf(w,
+				"----------------------------------------\n"+
+					"Name: %[1]s\n"+
+					"Desc: %[2]s\n"+
+					"Group: %[11]s\n"+
+					"Action: %[3]s\n"+
+					"Direction: %[7]s\n"+
+					"Profile: %[8]s\n"+
+					"Protocol: %[4]s\n"+
+					"Port: %[5]s\n"+
+					"IP: %[6]s\n"+
+					"RemotePort: %[9]s\n"+
+					"LocalIP: %[10]s\n",
+				rif.Name,
+				rif.Desc,
+				action,
+				rif.Protocol,
+				rif.Ports,
+				rif.IPs,
+				rif.Direction,
+				rif.Profile,
+				orAny(rif.RemotePorts),
+				orAny(rif.LocalIPs),
+				rif.Group,
+			)
+		}
+	}
+
+	if c.Format == "cmd" && c.Replace != "" {
+		// netsh cannot set groups.
+		// the rules are looked up by the names prefixed by --replace, leaving the other rules of the host alone
+		type nameGroup struct{ name, group string }
+		done := make(map[nameGroup]bool)
+		var groups []string
+		names := make(map[string][]string)
+		for _, rif := range ruleIFs {
+			ng := nameGroup{newline.ReplaceAllLiteralString(rif.Name, " "), rif.Group}
+			if done[ng] {
+				continue
+			}
+			done[ng] = true
+
+			if len(names[ng.group]) == 0 {
+				groups = append(groups, ng.group)
+			}
+			names[ng.group] = append(names[ng.group], psQuote(psEscapeWildcards(ng.name)))
+		}
+
+		// each line lists as many names as cmd.exe allows
+		for _, group := range groups {
+			head := "powershell -NoProfile -Command \"Get-NetFirewallRule -DisplayName "
+			tail := " | ForEach-Object { $_.Group = " + psQuote(group) + "; $_ | Set-NetFirewallRule }\""
+			for _, list := range joinUnder(names[group], ",", cmdLineMax-len(head)-len(tail)) {
+				fmt.Fprintf(w, "%s%s%s\r\n", head, list, tail)
+			}
+		}
+	}
+
+	return nil
+}
+
+// cmdLineMax is the maximum length of a command line of cmd.exe.
+const cmdLineMax = 8191
+
+// joinUnder joins items with sep into strings no longer than max, as few as possible.
+// An item longer than max is a string by itself.
+func joinUnder(items []string, sep string, max int) []string {
+	var result []string
+	var sb strings.Builder
+	for _, item := range items {
+		if sb.Len() > 0 && sb.Len()+len(sep)+len(item) > max {
+			result = append(result, sb.String())
+			sb.Reset()
+		}
+		if sb.Len() > 0 {
+			sb.WriteString(sep)
+		}
+		sb.WriteString(item)
+	}
+	if sb.Len() > 0 {
+		result = append(result, sb.String())
+	}
+	return result
+}
+
+// normalize validates and lowercases the options shared by subcommands.
+func (c *globalCmd) normalize() error {
+	c.Aggregation = strings.ToLower(c.Aggregation)
+	if c.Aggregation != "ip" && c.Aggregation != "port" {
+		return errors.New("--aggregation must be ip or port")
+	}
+
+	c.IPStyle = strings.ToLower(c.IPStyle)
+	if c.IPStyle != "range" && c.IPStyle != "cidr" {
+		return errors.New("--ip-style must be range or cidr")
+	}
+
+	c.Model = strings.ToLower(c.Model)
+	if _, ok := wfw.ModelByName(c.Model); !ok {
+		return errors.New("--model must be first-match, last-match or block-wins")
+	}
+
+	if p, err := parseProfile(c.HostProfile); err != nil || p.String() == "any" || strings.Contains(p.String(), ",") {
+		return errors.New("--host-profile must be domain, private or public")
+	}
+
+	// iptables, nft and firewall-cmd take names of chains and zones without quoting
+	if !regexp.MustCompile(`^[A-Za-z0-9_-]+$`).MatchString(c.Chain) {
+		return errors.New("--chain must consist of letters, digits, _ and -")
+	}
+
+	return nil
+}
+
+// hostProfile returns the profile of --host-profile, which must have been normalized.
+func (c globalCmd) hostProfile() wfw.Profile {
+	p, _ := parseProfile(c.HostProfile)
+	return p
+}
+
+// model returns the model of --model, which must have been normalized.
+func (c globalCmd) model() wfw.Model {
+	m, _ := wfw.ModelByName(c.Model)
+	return m
+}
+
+// generate resolves inRuleIFs, and defaults if --fill-gaps, into the rules to output.
+// It also returns the rule set of them, ordered so that its first matching rule decides in --model.
+func (c globalCmd) generate(inRuleIFs []RuleIF, defaults []DefaultIF) ([]RuleIF, wfw.RuleSet, error) {
+	group := c.group()
+	for i := range inRuleIFs {
+		if inRuleIFs[i].Group == "" {
+			inRuleIFs[i].Group = group
+		}
+	}
+
+	if !c.FillGaps {
+		defaults = nil
+	}
+	inRuleIFs, inRS, err := c.inputRuleSet(inRuleIFs, defaults)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := inRS.Hoge(c.Aggregation == "port", wfw.FirstMatchModel)
+
+	ruleIFs := ruleIFsFromRuleSet(result, c.Except, c.IPStyle, inRuleIFs)
+
+	// an ID depends only on the fragments of its source rule, so they are not joined with the others
+	if c.ID != "" {
+		for i := range ruleIFs {
+			ruleIFs[i].tag = ruleIFs[i].source
+		}
+	}
+
+	ruleIFs = joinRuleIFs(ruleIFs, c.Aggregation)
+
+	if c.ID != "" {
+		for i := range ruleIFs {
+			id, err := ruleID(ruleIFs[i], inRuleIFs[ruleIFs[i].source])
+			if err != nil {
+				return nil, nil, err
+			}
+			ruleIFs[i].Name += strings.Replace(c.ID, "%", id, 1)
+		}
+	}
+
+	return ruleIFs, inRS, nil
+}
+
+// group returns the group of rules without Group, --group or the name of the input file.
+func (c globalCmd) group() string {
+	if c.Group != "" {
+		return c.Group
+	}
+	group := filepath.Base(c.Input)
+	if ext := filepath.Ext(group); ext != "" {
+		group = group[:len(group)-len(ext)]
+	}
+	return group
+}
+
+// inputRuleSet returns the rule set of ruleIFs, ordered so that its first matching rule decides in --model,
+// followed by the rules of defaults for packets no rule matches.
+// It also returns ruleIFs followed by the rules of defaults, tagged by their index.
+func (c globalCmd) inputRuleSet(ruleIFs []RuleIF, defaults []DefaultIF) ([]RuleIF, wfw.RuleSet, error) {
+	inRS, err := ruleSetFromRuleIFs(ruleIFs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inRS = c.model().Ordered(inRS)
+
+	// defaults follow all rules
+	ruleIFs = append([]RuleIF{}, ruleIFs...)
+	for _, d := range defaults {
+		rif, err := defaultRuleIF(d)
+		if err != nil {
+			return nil, nil, err
+		}
+		rif.Group = c.group()
+		rif.tag = len(ruleIFs)
+		ruleIFs = append(ruleIFs, rif)
+
+		rs, err := ruleIFToRuleSet(rif)
+		if err != nil {
+			return nil, nil, err
+		}
+		inRS = append(inRS, rs...)
+	}
+
+	return ruleIFs, inRS, nil
+}
+
+// defaultRuleIF returns a rule matching all packets of d, with the action of d.
+func defaultRuleIF(d DefaultIF) (RuleIF, error) {
+	dir, err := parseDirection(d.Direction)
+	if err != nil {
+		return RuleIF{}, fmt.Errorf("default: %v", err)
+	}
+	if d.Protocol == "" {
+		return RuleIF{}, errors.New("default: Protocol is empty")
+	}
+
+	return RuleIF{
+		Name:      fmt.Sprintf("default %s %s %s", actionName(d.Allow), dir, strings.ToLower(d.Protocol)),
+		Allow:     d.Allow,
+		Direction: dir,
+		Protocol:  d.Protocol,
+		Ports:     "0-65535",
+		IPs:       "0.0.0.0/0,::/0",
+	}, nil
+}
+
+// ruleID returns a short hash of the source rule src and the match conditions of rif,
+// which does not depend on --ip-style or other rules.
+func ruleID(rif, src RuleIF) (string, error) {
+	canonical := func(ips string) (string, error) {
+		iprs, err := parseIPRanges(ips, true)
+		if err != nil {
+			return "", err
+		}
+		if iprs[0].Start == nil {
+			return "", nil
+		}
+
+		// join adjacent ranges, as CIDR prefixes are
+		sort.Slice(iprs, func(i, j int) bool {
+			if fi, fj := wfw.Family(iprs[i].Start), wfw.Family(iprs[j].Start); fi != fj {
+				return fi < fj
+			}
+			return iprs[i].Start.Less(iprs[j].Start)
+		})
+		var ss []string
+		cur := iprs[0]
+		for _, r := range iprs[1:] {
+			if wfw.Family(r.Start) == wfw.Family(cur.Start) &&
+				(!cur.End.Less(r.Start) || cur.End.Next().Equal(r.Start)) {
+				cur.End = rng.Max(cur.End, r.End)
+				continue
+			}
+			ss = append(ss, stringifyIPRange(cur, "range"))
+			cur = r
+		}
+		ss = append(ss, stringifyIPRange(cur, "range"))
+		return strings.Join(ss, ","), nil
+	}
+
+	ips, err := canonical(rif.IPs)
+	if err != nil {
+		return "", err
+	}
+	localips, err := canonical(rif.LocalIPs)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, s := range []string{
+		src.Group, src.Name, src.Direction, src.Protocol, strconv.FormatBool(src.Allow),
+		src.Profile, src.Ports, src.IPs, src.RemotePorts, src.LocalIPs,
+		rif.Profile, rif.Ports, ips, rif.RemotePorts, localips,
+	} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
+
+// loadRuleFile reads a rule file, either an array of rules or a RuleFileIF,
+// tagging each rule by its index.
+func loadRuleFile(path string) (RuleFileIF, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return RuleFileIF{}, err
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return RuleFileIF{}, err
+	}
+	file.Close()
+
+	var ruleFile RuleFileIF
+	if strings.HasPrefix(strings.TrimSpace(string(content)), "{") {
+		err = json.Unmarshal(content, &ruleFile)
+	} else {
+		err = json.Unmarshal(content, &ruleFile.Rules)
+	}
+	if err != nil {
+		return RuleFileIF{}, err
+	}
+
+	// tagging
+	for i := range ruleFile.Rules {
+		ruleFile.Rules[i].tag = i
+	}
+
+	return ruleFile, nil
+}
+
+// ruleSetFromRuleIFs converts ruleIFs, except commented out ones (# in the head of the name).
+func ruleSetFromRuleIFs(ruleIFs []RuleIF) (wfw.RuleSet, error) {
+	rs := wfw.RuleSet{}
+	for _, rif := range ruleIFs {
+		if strings.HasPrefix(rif.Name, "#") {
+			continue
+		}
+		r, err := ruleIFToRuleSet(rif)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r...)
+	}
+	return rs, nil
+}
+
+type verifyCmd struct{}
+
+func (c verifyCmd) Run(g *globalCmd, args []string) error {
+	if g.Input == "" {
+		if len(args) == 0 {
+			return errors.New("--input is empty")
+		}
+		g.Input = args[0]
+	}
+
+	if err := g.normalize(); err != nil {
+		return err
+	}
+
+	file, err := loadRuleFile(g.Input)
+	if err != nil {
+		return err
+	}
+
+	ruleIFs, inRS, err := g.generate(file.Rules, file.Defaults)
+	if err != nil {
+		return err
+	}
+
+	outRS, err := ruleSetFromRuleIFs(ruleIFs)
+	if err != nil {
+		return err
+	}
+
+	if ce := wfw.Verify(inRS, outRS, wfw.Dimensions(g.Aggregation == "port")); ce != nil {
+		return errors.New(describeCounterexample(ce))
+	}
+
+	fmt.Printf("OK: %d rules decide every packet as %d input rules do\n", len(ruleIFs), len(file.Rules))
+
+	return nil
+}
+
+type lintCmd struct{}
+
+func (c lintCmd) Run(g *globalCmd, args []string) error {
+	if g.Input == "" {
+		if len(args) == 0 {
+			return errors.New("--input is empty")
+		}
+		g.Input = args[0]
+	}
+
+	if err := g.normalize(); err != nil {
+		return err
+	}
+
+	file, err := loadRuleFile(g.Input)
+	if err != nil {
+		return err
+	}
+	inRuleIFs := file.Rules
+
+	inRS, err := ruleSetFromRuleIFs(inRuleIFs)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range g.model().Ordered(inRS).Lint() {
+		by := make([]string, 0, len(f.By))
+		for _, t := range f.By {
+			by = append(by, fmt.Sprintf("[%d] %s", t, inRuleIFs[t].Name))
+		}
+
+		fmt.Printf("[%d] %s: %s by %s\n", f.Tag, inRuleIFs[f.Tag].Name, f.Shadowing, strings.Join(by, ", "))
+	}
+
+	return nil
+}
+
+type diffCmd struct{}
+
+func (c diffCmd) Run(g *globalCmd, args []string) error {
+	if len(args) != 2 {
+		return errors.New("wfw diff needs two rule files, old and new")
+	}
+
+	if err := g.normalize(); err != nil {
+		return err
+	}
+
+	var files [2]RuleFileIF
+	for i, path := range args {
+		var err error
+		files[i], err = loadRuleFile(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.diff(os.Stdout, g, files)
+}
+
+// diff writes packets whose decisions change from the rules of files[0] to those of files[1].
+func (c diffCmd) diff(w io.Writer, g *globalCmd, files [2]RuleFileIF) error {
+	// packets no rule matches are decided by the defaults
+	var rss [2]wfw.RuleSet
+	for i, file := range files {
+		var err error
+		_, rss[i], err = g.inputRuleSet(file.Rules, file.Defaults)
+		if err != nil {
+			return err
+		}
+	}
+
+	changes := wfw.Diff(rss[0], rss[1], wfw.Dimensions(g.Aggregation == "port"))
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "no changes")
+		return nil
+	}
+
+	header := ""
+	for _, ch := range changes {
+		r := ch.Region
+		if h := fmt.Sprintf("== %s %s IPv%d", r.Direction, r.Protocol, wfw.Family(r.IP.Start)); h != header {
+			header = h
+			fmt.Fprintln(w, header)
+		}
+
+		var change string
+		switch ch.To {
+		case wfw.Allowed:
+			change = "newly allowed"
+		case wfw.Blocked:
+			change = "newly blocked"
+		default:
+			change = "no longer matched"
+		}
+
+		fmt.Fprintf(w, "%s (was %s): %s\n", change, ch.From, describeRegion(r, g.IPStyle))
+	}
+
+	return nil
+}
+
+type gapsCmd struct{}
+
+func (c gapsCmd) Run(g *globalCmd, args []string) error {
+	if g.Input == "" {
+		if len(args) == 0 {
+			return errors.New("--input is empty")
+		}
+		g.Input = args[0]
+	}
+
+	if err := g.normalize(); err != nil {
+		return err
+	}
+
+	file, err := loadRuleFile(g.Input)
+	if err != nil {
+		return err
+	}
+
+	inRS, err := ruleSetFromRuleIFs(file.Rules)
+	if err != nil {
+		return err
+	}
+
+	// the whole spaces of the defaults, tagged by the index of labels
+	var universe wfw.RuleSet
+	var labels []string
+	declared := make(map[string]bool)
+	for _, d := range file.Defaults {
+		rif, err := defaultRuleIF(d)
+		if err != nil {
+			return err
+		}
+		rif.tag = len(labels)
+		labels = append(labels, fmt.Sprintf("default %s", actionName(rif.Allow)))
+		declared[rif.Direction+" "+strings.ToLower(rif.Protocol)] = true
+
+		rs, err := ruleIFToRuleSet(rif)
+		if err != nil {
+			return err
+		}
+		universe = append(universe, rs...)
+	}
+
+	// and of the rules without defaults
+	undeclared := make(map[string]bool)
+	for _, r := range inRS {
+		key := fmt.Sprintf("%s %s %d", r.Direction, r.Protocol, wfw.Family(r.IP.Start))
+		// a default of any covers every protocol
+		if declared[r.Direction+" "+strings.ToLower(r.Protocol)] || declared[r.Direction+" any"] || undeclared[key] {
+			continue
+		}
+		undeclared[key] = true
+
+		universe = append(universe, wfw.Rule{
+			Direction: r.Direction,
+			Protocol:  r.Protocol,
+			Port:      wfw.AnyPort,
+			IP:        wfw.AnyIP(wfw.Family(r.IP.Start)),
+			Tag:       len(labels),
+		})
+		labels = append(labels, "no default")
+	}
+
+	gaps := wfw.Gaps(inRS, universe, wfw.Dimensions(g.Aggregation == "port"))
+	if len(gaps) == 0 {
+		fmt.Println("no gaps")
+		return nil
+	}
+
+	header := ""
+	for _, r := range gaps {
+		if h := fmt.Sprintf("== %s %s IPv%d (%s)", r.Direction, r.Protocol, wfw.Family(r.IP.Start), labels[r.Tag]); h != header {
+			header = h
+			fmt.Println(header)
+		}
+		fmt.Println(describeRegion(r, g.IPStyle))
+	}
+
+	return nil
+}
+
+// actionName returns "allow" or "block".
+func actionName(allow bool) string {
+	if allow {
+		return "allow"
+	}
+	return "block"
 }
 
-type RuleIF struct {
-	Name, Desc string
-	Allow      bool
-	Protocol   string
-	Ports      string `json:"Port"`
-	IPs        string `json:"IP"`
-	tag        int
+// describeRegion returns the ranges of r, omitting the remote port and the local IP if any.
+func describeRegion(r wfw.Rule, ipStyle string) string {
+	region := fmt.Sprintf("profile=%s  localport=%s  remoteip=%s", r.Profile, stringifyPortRange(r.Port), stringifyIPRange(r.IP, ipStyle))
+	if r.RemotePort.Start != nil {
+		region += "  remoteport=" + stringifyPortRange(r.RemotePort)
+	}
+	if r.LocalIP.Start != nil {
+		region += "  localip=" + stringifyIPRange(r.LocalIP, ipStyle)
+	}
+	return region
 }
 
-func (c globalCmd) Run(args []string) error {
+type queryCmd struct {
+	Input string `cli:"input,i" help:"rule file"`
+
+	Direction  string `cli:"direction" default:"in" help:"in or out"`
+	Profile    string `cli:"profile" default:"any" help:"domain, private, public or a list of them. each profile is queried"`
+	Protocol   string `cli:"protocol" default:"tcp"`
+	Port       string `cli:"port" help:"local port"`
+	IP         string `cli:"ip" help:"remote IP"`
+	RemotePort string `cli:"remote-port" help:"remote port, needed if a rule depends on it"`
+	LocalIP    string `cli:"local-ip" help:"local IP, needed if a rule depends on it"`
+}
+
+func (c queryCmd) Run(g *globalCmd, args []string) error {
+	if c.Input == "" {
+		c.Input = g.Input
+	}
 	if c.Input == "" {
 		if len(args) == 0 {
 			return errors.New("--input is empty")
@@ -61,145 +983,232 @@ func (c globalCmd) Run(args []string) error {
 		c.Input = args[0]
 	}
 
-	c.Aggregation = strings.ToLower(c.Aggregation)
-	if c.Aggregation != "ip" && c.Aggregation != "port" {
-		return errors.New("--aggregation must be ip or port")
+	if err := g.normalize(); err != nil {
+		return err
 	}
 
-	c.Format = strings.ToLower(c.Format)
-	if c.Format != "list" && c.Format != "json" && c.Format != "cmd" && c.Format != "svg" {
-		return errors.New("--format must be list,json,cmd or svg")
+	packet, err := c.packet()
+	if err != nil {
+		return err
 	}
 
-	file, err := os.Open(c.Input)
+	file, err := loadRuleFile(c.Input)
 	if err != nil {
 		return err
 	}
-	content, err := io.ReadAll(file)
+
+	return c.query(os.Stdout, g, packet, file)
+}
+
+// query writes, for each profile of packet, what the rules of file do to it,
+// and the input and output rules deciding it.
+func (c queryCmd) query(w io.Writer, g *globalCmd, packet wfw.Rule, file RuleFileIF) error {
+	ruleIFs, _, err := g.generate(file.Rules, file.Defaults)
 	if err != nil {
 		return err
 	}
-	file.Close()
 
-	var inRuleIFs []RuleIF
-	err = json.Unmarshal(content, &inRuleIFs)
+	// the input decides by the defaults, even without --fill-gaps
+	_, inRS, err := g.inputRuleSet(file.Rules, file.Defaults)
 	if err != nil {
 		return err
 	}
 
-	// tagging
-	for i := range inRuleIFs {
-		inRuleIFs[i].tag = i
+	// tag generated rules by their index
+	for i := range ruleIFs {
+		ruleIFs[i].tag = i
+	}
+	outRS, err := ruleSetFromRuleIFs(ruleIFs)
+	if err != nil {
+		return err
 	}
 
-	inRS := wfw.RuleSet{}
-	for _, rif := range inRuleIFs {
-		if strings.HasPrefix(rif.Name, "#") {
+	for _, profile := range []wfw.Profile{wfw.ProfileDomain, wfw.ProfilePrivate, wfw.ProfilePublic} {
+		if !packet.Profile.Contains(profile) {
 			continue
 		}
-		inRS = append(inRS, ruleIFToRuleSet(rif)...)
-	}
 
-	result := inRS.Hoge(c.Aggregation == "port")
+		p := packet
+		p.Profile = profile
 
-	ruleIFs := ruleIFsFromRuleSet(result, c.Except, inRuleIFs)
+		if err := c.checkDependency(inRS, p); err != nil {
+			return err
+		}
 
-	ruleIFs = joinRuleIFs(ruleIFs, c.Aggregation)
+		in := inRS.FirstMatch(p)
+		out := outRS.BlockWins(p)
 
-	if c.Format == "json" {
-		content, err := json.MarshalIndent(ruleIFs, "", "  ")
-		if err != nil {
-			return err
+		fmt.Fprintln(w, "----------------------------------------")
+		fmt.Fprintf(w, "Profile: %s\n", profile)
+		if in >= 0 {
+			action := "allow"
+			if !inRS[in].Allow {
+				action = "BLOCK"
+			}
+			fmt.Fprintf(w, "Action: %s\n", action)
+			fmt.Fprintf(w, "Input: [%d] %s\n", inRS[in].Tag, inRS[in].Name)
+		} else {
+			fmt.Fprintln(w, "Action: no match")
+			fmt.Fprintln(w, "Input: -")
+		}
+		if out >= 0 {
+			fmt.Fprintf(w, "Output: [%d] %s\n", outRS[out].Tag, ruleIFs[outRS[out].Tag].Name)
+		} else {
+			fmt.Fprintln(w, "Output: -")
 		}
+	}
 
-		fmt.Println(string(content))
+	return nil
+}
 
-		return nil
+// packet returns a rule matching only the queried packet, except its profile.
+// Unless given, the remote port and the local IP are any.
+func (c queryCmd) packet() (wfw.Rule, error) {
+	dir, err := parseDirection(c.Direction)
+	if err != nil {
+		return wfw.Rule{}, err
 	}
 
-	if c.Format == "svg" {
-		name := c.Input
-		if ext := filepath.Ext(name); ext != "" {
-			name = name[:len(name)-len(ext)]
+	profile, err := parseProfile(c.Profile)
+	if err != nil {
+		return wfw.Rule{}, err
+	}
+
+	if c.Protocol == "" {
+		return wfw.Rule{}, errors.New("--protocol is empty")
+	}
+
+	port, err := parsePort(c.Port, "--port")
+	if err != nil {
+		return wfw.Rule{}, err
+	}
+
+	ip, err := parseIP(c.IP)
+	if err != nil {
+		return wfw.Rule{}, fmt.Errorf("--ip: %v", err)
+	}
+
+	packet := wfw.Rule{
+		Direction: dir,
+		Profile:   profile,
+		Protocol:  c.Protocol,
+		Port:      rng.NewRange(port, port),
+		IP:        rng.NewRange(ip, ip),
+	}
+
+	if c.RemotePort != "" {
+		rp, err := parsePort(c.RemotePort, "--remote-port")
+		if err != nil {
+			return wfw.Rule{}, err
 		}
-		err := saveAsSVG(ruleIFs, name, c.SVGDir, c.SVGNameFormat, c.Aggregation)
+		packet.RemotePort = rng.NewRange(rp, rp)
+	}
+
+	if c.LocalIP != "" {
+		lip, err := parseIP(c.LocalIP)
 		if err != nil {
-			return err
+			return wfw.Rule{}, fmt.Errorf("--local-ip: %v", err)
 		}
-		return nil
+		if wfw.Family(lip) != wfw.Family(ip) {
+			return wfw.Rule{}, errors.New("--local-ip and --ip must be of the same family")
+		}
+		packet.LocalIP = rng.NewRange(lip, lip)
 	}
 
-	// c.Format is "cmd" or "list"
+	return packet, nil
+}
 
-	newline, err := regexp.Compile(`\r\n|\r|\n`)
-	if err != nil {
-		return err
+// checkDependency returns an error if the first matching rule depends on the remote port or the local IP,
+// which are not given.
+func (c queryCmd) checkDependency(rs wfw.RuleSet, packet wfw.Rule) error {
+	for _, r := range rs {
+		if r.Contains(packet) {
+			return nil
+		}
+
+		p := packet
+		if c.RemotePort == "" {
+			p.RemotePort = r.RemotePort
+		}
+		if c.LocalIP == "" {
+			p.LocalIP = r.LocalIP
+		}
+		if !r.Contains(p) {
+			continue
+		}
+
+		if c.RemotePort == "" && r.RemotePort.Start != nil {
+			return fmt.Errorf("rule %q depends on the remote port. specify --remote-port", r.Name)
+		}
+		return fmt.Errorf("rule %q depends on the local IP. specify --local-ip", r.Name)
 	}
+	return nil
+}
 
-	for _, rif := range ruleIFs {
-		if c.Format == "cmd" {
-			var enabled string
-			if !c.Enabled {
-				enabled = "enable=no"
-			}
+// parsePort parses s as a port, naming the option in errors.
+func parsePort(s, option string) (rng.Int, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, fmt.Errorf("%s is empty", option)
+	}
+	p, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || p < 0 || p > 65535 {
+		return 0, fmt.Errorf("%s: invalid port %q", option, s)
+	}
+	return rng.Int(p), nil
+}
 
-			name := "name=\"" + newline.ReplaceAllLiteralString(rif.Name, " ") + "\""
-			action := "action="
-			if rif.Allow {
-				action += "allow"
-			} else {
-				action += "block"
-			}
+func describeCounterexample(ce *wfw.Counterexample) string {
+	p := ce.Packet
+	packet := fmt.Sprintf("dir=%s profile=%s protocol=%s localport=%s remoteip=%s remoteport=%s localip=%s",
+		p.Direction, p.Profile, p.Protocol,
+		stringifyPortRange(p.Port), StringifySeq(p.IP.Start),
+		stringifyPortRange(p.RemotePort), StringifySeq(p.LocalIP.Start))
 
-			var description string
-			if len(rif.Desc) != 0 {
-				description = "description=\"" + newline.ReplaceAllLiteralString(rif.Desc, " ") + "\""
-			}
+	decision := func(d wfw.Decision, r *wfw.Rule) string {
+		if r == nil {
+			return d.String()
+		}
+		return fmt.Sprintf("%s by %q", d, r.Name)
+	}
 
-			remoteip := "remoteip=\"" + rif.IPs + "\""
-			localport := "localport=\"" + rif.Ports + "\""
-			protocol := "protocol=\"" + strings.ToLower(rif.Protocol) + "\""
+	return fmt.Sprintf("counterexample: %s: input: %s, output: %s",
+		packet, decision(ce.Want, ce.WantRule), decision(ce.Got, ce.GotRule))
+}
 
-			if protocol != "protocol=\"tcp\"" && protocol != "protocol=\"udp\"" {
-				localport = ""
-			}
+func orAny(s string) string {
+	if s == "" {
+		return "any"
+	}
+	return s
+}
 
-			fmt.Printf(
-				"netsh advfirewall firewall add rule  %[1]s  %[2]s  %[3]s  dir=in  profile=any  %[4]s  %[5]s  %[6]s  %[7]s\r\n",
-				name,
-				enabled,
-				description,
-				action,
-				protocol,
-				localport,
-				remoteip,
-			)
-		} else {
-			var action string
-			if rif.Allow {
-				action = "allow"
-			} else {
-				action = "BLOCK"
-			}
-			fmt.Printf(
-				"----------------------------------------\n"+
-					"Name: %[1]s\n"+
-					"Desc: %[2]s\n"+
-					"Action: %[3]s\n"+
-					"Protocol: %[4]s\n"+
-					"Port: %[5]s\n"+
-					"IP: %[6]s\n",
-				rif.Name,
-				rif.Desc,
-				action,
-				rif.Protocol,
-				rif.Ports,
-				rif.IPs,
-			)
+// psQuote quotes s as a PowerShell single-quoted string.
+func psQuote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('\'')
+	for _, r := range s {
+		// PowerShell also treats typographic single quotes as quotes
+		if r == '\'' || r == '\u2018' || r == '\u2019' || r == '\u201a' || r == '\u201b' {
+			sb.WriteRune(r)
 		}
+		sb.WriteRune(r)
 	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
 
-	return nil
+// psEscapeWildcards escapes s to be matched literally by a -DisplayName pattern.
+func psEscapeWildcards(s string) string {
+	return strings.NewReplacer("`", "``", "*", "`*", "?", "`?", "[", "`[", "]", "`]").Replace(s)
+}
+
+// psArray converts a comma-joined list into a PowerShell array literal.
+func psArray(s string) string {
+	items := strings.Split(s, ",")
+	for i := range items {
+		items[i] = psQuote(strings.TrimSpace(items[i]))
+	}
+	return strings.Join(items, ",")
 }
 
 type genCmd struct {
@@ -213,44 +1222,54 @@ func (c genCmd) Run() error {
 
 	rules := []RuleIF{
 		{
-			Name:     "allow HTTPS",
-			Desc:     "1st priority",
-			Allow:    true,
-			Protocol: "TCP",
-			Ports:    "443",
-			IPs:      "192.168.0.1-192.168.255.255",
+			Name:      "allow HTTPS",
+			Desc:      "1st priority",
+			Allow:     true,
+			Direction: "in",
+			Profile:   "any",
+			Protocol:  "TCP",
+			Ports:     "443",
+			IPs:       "192.168.0.1-192.168.255.255",
 		},
 		{
-			Name:     "allow HTTP from .0.101",
-			Desc:     "2nd priority",
-			Allow:    true,
-			Protocol: "TCP",
-			Ports:    "80,443,8080",
-			IPs:      "192.168.0.101",
+			Name:      "allow HTTP from .0.101",
+			Desc:      "2nd priority",
+			Allow:     true,
+			Direction: "in",
+			Profile:   "any",
+			Protocol:  "TCP",
+			Ports:     "80,443,8080",
+			IPs:       "192.168.0.101",
 		},
 		{
-			Name:     "deny TCP from 192.168.",
-			Desc:     "3rd priority",
-			Allow:    false,
-			Protocol: "TCP",
-			Ports:    "0-65535",
-			IPs:      "192.168.0.1-192.168.255.255",
+			Name:      "deny TCP from 192.168.",
+			Desc:      "3rd priority",
+			Allow:     false,
+			Direction: "in",
+			Profile:   "any",
+			Protocol:  "TCP",
+			Ports:     "0-65535",
+			IPs:       "192.168.0.1-192.168.255.255",
 		},
 		{
-			Name:     "deny UDP from 192.168.",
-			Desc:     "3rd priority",
-			Allow:    false,
-			Protocol: "UDP",
-			Ports:    "0-65535",
-			IPs:      "192.168.0.1-192.168.255.255",
+			Name:      "deny UDP from 192.168.",
+			Desc:      "3rd priority",
+			Allow:     false,
+			Direction: "in",
+			Profile:   "any",
+			Protocol:  "UDP",
+			Ports:     "0-65535",
+			IPs:       "192.168.0.1-192.168.255.255",
 		},
 		{
-			Name:     "allow RDP from .0.101",
-			Desc:     "4th priority, this rule will be disappeared",
-			Allow:    true,
-			Protocol: "TCP",
-			Ports:    "3389",
-			IPs:      "192.168.0.101",
+			Name:      "allow RDP from .0.101",
+			Desc:      "4th priority, this rule will be disappeared",
+			Allow:     true,
+			Direction: "in",
+			Profile:   "any",
+			Protocol:  "TCP",
+			Ports:     "3389",
+			IPs:       "192.168.0.101",
 		},
 	}
 
@@ -280,14 +1299,33 @@ func Int(s string) rng.Int {
 func StringifySeq(s rng.Sequential) string {
 	if ip, ok := s.(rng.IPv4); ok {
 		return fmt.Sprintf("%v.%v.%v.%v", ip[0], ip[1], ip[2], ip[3])
+	} else if ip, ok := s.(wfw.IPv6); ok {
+		return ip.String()
 	} else if i, ok := s.(rng.Int); ok {
 		return strconv.Itoa(int(i))
 	}
 	return ""
 }
 
+func stringifyPortRange(r rng.Range) string {
+	if r.Start.Equal(r.End) {
+		return StringifySeq(r.Start)
+	}
+	return StringifySeq(r.Start) + "-" + StringifySeq(r.End)
+}
+
+func stringifyIPRange(r rng.Range, ipStyle string) string {
+	if ipStyle == "cidr" {
+		return strings.Join(cidrsFromRange(r), ",")
+	}
+	if r.Start.Equal(r.End) {
+		return StringifySeq(r.Start)
+	}
+	return StringifySeq(r.Start) + "-" + StringifySeq(r.End)
+}
+
 // origIFs is referred on building Excepts
-func ruleIFsFromRuleSet(rs wfw.RuleSet, exceptFormat string, origIFs []RuleIF) []RuleIF {
+func ruleIFsFromRuleSet(rs wfw.RuleSet, exceptFormat, ipStyle string, origIFs []RuleIF) []RuleIF {
 	var ruleIFs []RuleIF
 	for _, r := range rs {
 		name := r.Name
@@ -310,18 +1348,22 @@ func ruleIFsFromRuleSet(rs wfw.RuleSet, exceptFormat string, origIFs []RuleIF) [
 		}
 
 		rif := RuleIF{
-			Name:     name, //r.Name,
-			Desc:     r.Desc,
-			Protocol: r.Protocol,
-			Allow:    r.Allow,
-			Ports:    StringifySeq(r.Port.Start) + "-" + StringifySeq(r.Port.End),
-			IPs:      StringifySeq(r.IP.Start) + "-" + StringifySeq(r.IP.End),
+			Name:      name, //r.Name,
+			Desc:      r.Desc,
+			Group:     r.Group,
+			source:    r.Tag,
+			Direction: r.Direction,
+			Profile:   r.Profile.String(),
+			Protocol:  r.Protocol,
+			Allow:     r.Allow,
+			Ports:     stringifyPortRange(r.Port),
 		}
-		if r.Port.Start.Equal(r.Port.End) {
-			rif.Ports = StringifySeq(r.Port.Start)
+		rif.IPs = stringifyIPRange(r.IP, ipStyle)
+		if r.RemotePort.Start != nil {
+			rif.RemotePorts = stringifyPortRange(r.RemotePort)
 		}
-		if r.IP.Start.Equal(r.IP.End) {
-			rif.IPs = StringifySeq(r.IP.Start)
+		if r.LocalIP.Start != nil {
+			rif.LocalIPs = stringifyIPRange(r.LocalIP, ipStyle)
 		}
 		ruleIFs = append(ruleIFs, rif)
 	}
@@ -348,8 +1390,9 @@ func joinRuleIFs(ruleIFs []RuleIF, aggregation string) []RuleIF {
 func joinRuleIFsByPorts(ruleIFs []RuleIF) []RuleIF {
 	for i := len(ruleIFs) - 2; i >= 0; i-- {
 		for k := i + 1; k < len(ruleIFs); k++ {
-			if ruleIFs[k].tag == ruleIFs[i].tag && ruleIFs[k].Protocol == ruleIFs[i].Protocol && ruleIFs[k].Allow == ruleIFs[i].Allow &&
-				ruleIFs[k].Ports == ruleIFs[i].Ports {
+			if ruleIFs[k].tag == ruleIFs[i].tag && ruleIFs[k].Group == ruleIFs[i].Group && ruleIFs[k].Direction == ruleIFs[i].Direction && ruleIFs[k].Profile == ruleIFs[i].Profile && strings.EqualFold(ruleIFs[k].Protocol, ruleIFs[i].Protocol) && ruleIFs[k].Allow == ruleIFs[i].Allow &&
+				ruleIFs[k].RemotePorts == ruleIFs[i].RemotePorts && ruleIFs[k].LocalIPs == ruleIFs[i].LocalIPs &&
+				ruleIFs[k].Ports == ruleIFs[i].Ports && ipFamily(ruleIFs[k].IPs) == ipFamily(ruleIFs[i].IPs) {
 				//
 				ruleIFs[i].IPs += "," + ruleIFs[k].IPs
 				ruleIFs = append(ruleIFs[:k], ruleIFs[k+1:]...)
@@ -362,7 +1405,8 @@ func joinRuleIFsByPorts(ruleIFs []RuleIF) []RuleIF {
 func joinRuleIFsByIPs(ruleIFs []RuleIF) []RuleIF {
 	for i := len(ruleIFs) - 2; i >= 0; i-- {
 		for k := i + 1; k < len(ruleIFs); k++ {
-			if ruleIFs[k].tag == ruleIFs[i].tag && ruleIFs[k].Protocol == ruleIFs[i].Protocol && ruleIFs[k].Allow == ruleIFs[i].Allow &&
+			if ruleIFs[k].tag == ruleIFs[i].tag && ruleIFs[k].Group == ruleIFs[i].Group && ruleIFs[k].Direction == ruleIFs[i].Direction && ruleIFs[k].Profile == ruleIFs[i].Profile && strings.EqualFold(ruleIFs[k].Protocol, ruleIFs[i].Protocol) && ruleIFs[k].Allow == ruleIFs[i].Allow &&
+				ruleIFs[k].RemotePorts == ruleIFs[i].RemotePorts && ruleIFs[k].LocalIPs == ruleIFs[i].LocalIPs &&
 				ruleIFs[k].IPs == ruleIFs[i].IPs {
 				//
 				ruleIFs[i].Ports += "," + ruleIFs[k].Ports
@@ -373,10 +1417,219 @@ func joinRuleIFsByIPs(ruleIFs []RuleIF) []RuleIF {
 	return ruleIFs
 }
 
-func ruleIFToRuleSet(rif RuleIF) wfw.RuleSet {
+// parseIP parses s as an IPv4 or IPv6 address.
+func parseIP(s string) (rng.Sequential, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	return seqFromAddr(addr), nil
+}
+
+func seqFromAddr(addr netip.Addr) rng.Sequential {
+	if addr.Is4() {
+		return rng.NewIPv4(addr.String())
+	}
+	return wfw.NewIPv6(addr.String())
+}
+
+// parseIPRange parses s as one of
+//   - a bare address: 192.168.0.1
+//   - a range: 192.168.0.1-192.168.0.100
+//   - a CIDR block: 192.168.0.0/24
+func parseIPRange(s string) (rng.Range, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return rng.Invalid, err
+		}
+		prefix = prefix.Masked()
+
+		return rng.NewRange(seqFromAddr(prefix.Addr()), seqFromAddr(lastAddr(prefix))), nil
+	}
+
+	ipip := strings.Split(s, "-")
+	if len(ipip) > 2 {
+		return rng.Invalid, fmt.Errorf("too many '-' in %q", s)
+	}
+
+	start, err := parseIP(ipip[0])
+	if err != nil {
+		return rng.Invalid, err
+	}
+	if len(ipip) == 1 {
+		return rng.NewRange(start, start), nil
+	}
+
+	end, err := parseIP(ipip[1])
+	if err != nil {
+		return rng.Invalid, err
+	}
+	if wfw.Family(start) != wfw.Family(end) {
+		return rng.Invalid, fmt.Errorf("mixed address families in %q", s)
+	}
+	if end.Less(start) {
+		return rng.Invalid, fmt.Errorf("reversed range %q", s)
+	}
+
+	return rng.NewRange(start, end), nil
+}
+
+// lastAddr returns the last address of prefix, whose host bits are all 1.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	last := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(last)*8; i++ {
+		last[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(last)
+	return addr
+}
+
+func addrFromSeq(s rng.Sequential) netip.Addr {
+	if ip, ok := s.(rng.IPv4); ok {
+		return netip.AddrFrom4([4]byte{byte(ip[0]), byte(ip[1]), byte(ip[2]), byte(ip[3])})
+	}
+	return netip.MustParseAddr(StringifySeq(s))
+}
+
+// trimHostPrefix returns cidr without the prefix length of a single address,
+// /32 of IPv4 or /128 of IPv6.
+func trimHostPrefix(cidr string) string {
+	if strings.Contains(cidr, ":") {
+		return strings.TrimSuffix(cidr, "/128")
+	}
+	return strings.TrimSuffix(cidr, "/32")
+}
+
+// cidrsFromRange returns the minimal list of CIDR prefixes covering r.
+func cidrsFromRange(r rng.Range) []string {
+	start, end := addrFromSeq(r.Start), addrFromSeq(r.End)
+
+	var cidrs []string
+	for {
+		// the largest block that starts at start and does not exceed end
+		var prefix netip.Prefix
+		for bits := 0; bits <= start.BitLen(); bits++ {
+			prefix = netip.PrefixFrom(start, bits)
+			if prefix.Masked().Addr() == start && lastAddr(prefix).Compare(end) <= 0 {
+				break
+			}
+		}
+		cidrs = append(cidrs, prefix.String())
+
+		last := lastAddr(prefix)
+		if last.Compare(end) >= 0 {
+			break
+		}
+		start = last.Next()
+	}
+
+	return cidrs
+}
+
+// ipFamily returns the address family of an IPs string of RuleIF.
+func ipFamily(ips string) int {
+	if strings.Contains(ips, ":") {
+		return 6
+	}
+	return 4
+}
+
+// parseDirection normalizes s into "in" or "out".
+func parseDirection(s string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "in", "inbound":
+		return "in", nil
+	case "out", "outbound":
+		return "out", nil
+	}
+	return "", fmt.Errorf("unknown direction %q", s)
+}
+
+// parseProfile parses s as a comma-separated list of profiles.
+// An empty string means any profile.
+func parseProfile(s string) (wfw.Profile, error) {
+	var profile wfw.Profile
+	if strings.TrimSpace(s) == "" {
+		return wfw.ProfileAny, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		p, ok := wfw.ProfileByName(name)
+		if !ok {
+			return 0, fmt.Errorf("unknown profile %q", strings.TrimSpace(name))
+		}
+		profile |= p
+	}
+	return profile, nil
+}
+
+func ruleIFToRuleSet(rif RuleIF) (wfw.RuleSet, error) {
 	var rs wfw.RuleSet
 
-	for _, p := range strings.Split(rif.Ports, ",") {
+	dir, err := parseDirection(rif.Direction)
+	if err != nil {
+		return nil, fmt.Errorf("rule %q: %v", rif.Name, err)
+	}
+
+	profile, err := parseProfile(rif.Profile)
+	if err != nil {
+		return nil, fmt.Errorf("rule %q: %v", rif.Name, err)
+	}
+
+	iprs, err := parseIPRanges(rif.IPs, false)
+	if err != nil {
+		return nil, fmt.Errorf("rule %q: %v", rif.Name, err)
+	}
+
+	localiprs, err := parseIPRanges(rif.LocalIPs, true)
+	if err != nil {
+		return nil, fmt.Errorf("rule %q: %v", rif.Name, err)
+	}
+
+	for _, pr := range parsePortRanges(rif.Ports, false) {
+		for _, ipr := range iprs {
+			for _, rpr := range parsePortRanges(rif.RemotePorts, true) {
+				for _, lipr := range localiprs {
+					// a local IP must be of the same family as the remote one
+					if lipr.Start != nil && wfw.Family(lipr.Start) != wfw.Family(ipr.Start) {
+						continue
+					}
+
+					r := wfw.Rule{
+						Name:       rif.Name,
+						Desc:       rif.Desc,
+						Group:      rif.Group,
+						Direction:  dir,
+						Profile:    profile,
+						Protocol:   rif.Protocol,
+						Allow:      rif.Allow,
+						Port:       pr,
+						IP:         ipr,
+						RemotePort: rpr,
+						LocalIP:    lipr,
+						Original:   true,
+						Tag:        rif.tag,
+					}
+					rs = append(rs, r)
+				}
+			}
+		}
+	}
+
+	return rs, nil
+}
+
+// parsePortRanges parses s as a comma-separated list of ports and ranges.
+// If orAny, an empty string or "any" results in a zero range, which means any.
+func parsePortRanges(s string, orAny bool) []rng.Range {
+	if orAny && isAny(s) {
+		return []rng.Range{{}}
+	}
+
+	var prs []rng.Range
+	for _, p := range strings.Split(s, ",") {
 		pp := strings.Split(p, "-")
 		var pr rng.Range
 		if len(pp) > 1 {
@@ -384,37 +1637,39 @@ func ruleIFToRuleSet(rif RuleIF) wfw.RuleSet {
 		} else {
 			pr = rng.NewRange(Int(pp[0]), Int(pp[0]))
 		}
+		prs = append(prs, pr)
+	}
+	return prs
+}
 
-		for _, ip := range strings.Split(rif.IPs, ",") {
-			ipip := strings.Split(ip, "-")
-			var ipr rng.Range
-			if len(ipip) > 1 {
-				ipr = rng.NewRange(rng.NewIPv4(strings.TrimSpace(ipip[0])), rng.NewIPv4(strings.TrimSpace(ipip[1])))
-			} else {
-				ipr = rng.NewRange(rng.NewIPv4(strings.TrimSpace(ipip[0])), rng.NewIPv4(strings.TrimSpace(ipip[0])))
-			}
+// parseIPRanges parses s as a comma-separated list of parseIPRange.
+// If orAny, an empty string or "any" results in a zero range, which means any.
+func parseIPRanges(s string, orAny bool) ([]rng.Range, error) {
+	if orAny && isAny(s) {
+		return []rng.Range{{}}, nil
+	}
 
-			r := wfw.Rule{
-				Name:     rif.Name,
-				Desc:     rif.Desc,
-				Protocol: rif.Protocol,
-				Allow:    rif.Allow,
-				Port:     pr,
-				IP:       ipr,
-				Original: true,
-				Tag:      rif.tag,
-			}
-			rs = append(rs, r)
+	var iprs []rng.Range
+	for _, ip := range strings.Split(s, ",") {
+		ipr, err := parseIPRange(ip)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q: %v", strings.TrimSpace(ip), err)
 		}
+		iprs = append(iprs, ipr)
 	}
+	return iprs, nil
+}
 
-	return rs
+func isAny(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.EqualFold(s, "any")
 }
 
 func saveAsSVG(ruleIFs []RuleIF, dest, dir, nameFormat, aggregation string) error {
-	protocolSet := make(map[string]struct{})
+	type space struct{ direction, protocol string }
+	spaceSet := make(map[space]struct{})
 	portSet := make(map[rng.Int]struct{})
-	ipSet := make(map[rng.IPv4]struct{})
+	ipSet := make(map[rng.Sequential]struct{})
 
 	rs := wfw.RuleSet{}
 	for i := range ruleIFs {
@@ -422,15 +1677,18 @@ func saveAsSVG(ruleIFs []RuleIF, dest, dir, nameFormat, aggregation string) erro
 		ruleIFs[i].tag = i
 
 		// convert from []RuleIF to RuleSet back again
-		rsrs := ruleIFToRuleSet(ruleIFs[i])
+		rsrs, err := ruleIFToRuleSet(ruleIFs[i])
+		if err != nil {
+			return err
+		}
 
 		for _, r := range rsrs {
 			// scan ports and ips
 			portSet[r.Port.Start.(rng.Int)] = struct{}{}
 			portSet[r.Port.End.(rng.Int)] = struct{}{}
-			ipSet[r.IP.Start.(rng.IPv4)] = struct{}{}
-			ipSet[r.IP.End.(rng.IPv4)] = struct{}{}
-			protocolSet[r.Protocol] = struct{}{}
+			ipSet[r.IP.Start] = struct{}{}
+			ipSet[r.IP.End] = struct{}{}
+			spaceSet[space{r.Direction, r.Protocol}] = struct{}{}
 		}
 
 		rs = append(rs, rsrs...)
@@ -444,11 +1702,15 @@ func saveAsSVG(ruleIFs []RuleIF, dest, dir, nameFormat, aggregation string) erro
 		return ports[i].Less(ports[j])
 	})
 
-	var ips []rng.IPv4
+	var ips []rng.Sequential
 	for i := range ipSet {
 		ips = append(ips, i)
 	}
 	sort.Slice(ips, func(i, j int) bool {
+		// IPv4 first, then IPv6
+		if fi, fj := wfw.Family(ips[i]), wfw.Family(ips[j]); fi != fj {
+			return fi < fj
+		}
 		return ips[i].Less(ips[j])
 	})
 
@@ -458,13 +1720,13 @@ func saveAsSVG(ruleIFs []RuleIF, dest, dir, nameFormat, aggregation string) erro
 	const fontSize = 12
 
 	width := leftMargin + len(ports)*cellSize
-	height := topMargin + len(ips)*cellSize + fontSize*5
+	height := topMargin + len(ips)*cellSize + fontSize*8
 
 	wk := make(wfw.RuleSet, 0, len(rs))
-	for protocol := range protocolSet {
+	for sp := range spaceSet {
 		wk = wk[:0]
 		for i := range rs {
-			if rs[i].Protocol == protocol {
+			if rs[i].Direction == sp.direction && rs[i].Protocol == sp.protocol {
 				wk = append(wk, rs[i])
 			}
 		}
@@ -474,8 +1736,14 @@ func saveAsSVG(ruleIFs []RuleIF, dest, dir, nameFormat, aggregation string) erro
 		if dest == "stdout" {
 			canvas = svg.New(os.Stdout)
 		} else {
-			name := strings.Replace(nameFormat, "%", dest, -1)
-			name = strings.Replace(name, "{protocol}", protocol, -1)
+			name := nameFormat
+			if !strings.Contains(name, "{direction}") && sp.direction != "in" {
+				ext := filepath.Ext(name)
+				name = name[:len(name)-len(ext)] + "_{direction}" + ext
+			}
+			name = strings.Replace(name, "%", dest, -1)
+			name = strings.Replace(name, "{protocol}", sp.protocol, -1)
+			name = strings.Replace(name, "{direction}", sp.direction, -1)
 			name = strings.Replace(name, "{aggregation}", aggregation, -1)
 
 			var err error
@@ -502,7 +1770,7 @@ rect:hover{stroke:green}
 `)
 
 		for y, p := range ips {
-			ip := fmt.Sprintf("%v", p)
+			ip := StringifySeq(p)
 			canvas.Text(0, topMargin+y*cellSize+cellSize/2, ip, "font-size:"+strconv.Itoa(fontSize)+"px; dominant-baseline:central")
 		}
 		for x, p := range ports {
@@ -516,6 +1784,9 @@ rect:hover{stroke:green}
 		canvas.Text(leftMargin, topMargin+len(ips)*cellSize+fontSize*3, "", "font-size:"+strconv.Itoa(fontSize)+"px", `class="wfw-allow"`)
 		canvas.Text(leftMargin, topMargin+len(ips)*cellSize+fontSize*4, "", "font-size:"+strconv.Itoa(fontSize)+"px", `class="wfw-ip"`)
 		canvas.Text(leftMargin, topMargin+len(ips)*cellSize+fontSize*5, "", "font-size:"+strconv.Itoa(fontSize)+"px", `class="wfw-port"`)
+		canvas.Text(leftMargin, topMargin+len(ips)*cellSize+fontSize*6, "", "font-size:"+strconv.Itoa(fontSize)+"px", `class="wfw-profile"`)
+		canvas.Text(leftMargin, topMargin+len(ips)*cellSize+fontSize*7, "", "font-size:"+strconv.Itoa(fontSize)+"px", `class="wfw-remoteport"`)
+		canvas.Text(leftMargin, topMargin+len(ips)*cellSize+fontSize*8, "", "font-size:"+strconv.Itoa(fontSize)+"px", `class="wfw-localip"`)
 
 		canvas.Translate(leftMargin, topMargin)
 
@@ -584,6 +1855,9 @@ rect:hover{stroke:green}
 				`wfw-allow="`+allowclass+`"`,
 				`wfw-ip="`+rif.IPs+`"`,
 				`wfw-port="`+rif.Ports+`"`,
+				`wfw-profile="`+rif.Profile+`"`,
+				`wfw-remoteport="`+orAny(rif.RemotePorts)+`"`,
+				`wfw-localip="`+orAny(rif.LocalIPs)+`"`,
 			)
 		}
 
@@ -604,6 +1878,9 @@ rect:hover{stroke:green}
         document.getElementsByClassName("wfw-allow")[0].textContent = this.getAttribute("wfw-allow")
         document.getElementsByClassName("wfw-ip")[0].textContent = this.getAttribute("wfw-ip")
         document.getElementsByClassName("wfw-port")[0].textContent = this.getAttribute("wfw-port")
+        document.getElementsByClassName("wfw-profile")[0].textContent = this.getAttribute("wfw-profile")
+        document.getElementsByClassName("wfw-remoteport")[0].textContent = this.getAttribute("wfw-remoteport")
+        document.getElementsByClassName("wfw-localip")[0].textContent = this.getAttribute("wfw-localip")
         for (var rr of document.getElementsByClassName(rule)) {
             rr.classList.add("onmouse")
         }
@@ -622,6 +1899,9 @@ rect:hover{stroke:green}
         document.getElementsByClassName("wfw-allow")[0].textContent = ""
         document.getElementsByClassName("wfw-ip")[0].textContent = ""
         document.getElementsByClassName("wfw-port")[0].textContent = ""
+        document.getElementsByClassName("wfw-profile")[0].textContent = ""
+        document.getElementsByClassName("wfw-remoteport")[0].textContent = ""
+        document.getElementsByClassName("wfw-localip")[0].textContent = ""
         for (var rr of document.getElementsByClassName(rule)) {
             rr.classList.remove("onmouse")
         }
@@ -645,7 +1925,14 @@ func main() {
 	app.Version = Version
 	app.Usage = `wfw gen
 wfw example.json
-wfw --format cmd example.json`
+wfw --format cmd example.json
+wfw verify example.json
+wfw lint example.json
+wfw diff old.json new.json
+wfw --model block-wins exported.json
+wfw gaps example.json
+wfw import --from netsh dump.txt > example.json
+wfw query -i example.json --protocol tcp --port 3389 --ip 192.168.0.101`
 	app.Copyright = "(C) 2021 Shuhei Kubota"
 	app.SuppressErrorOutput = true
 	err := app.Run(os.Args)
@@ -0,0 +1,1114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/shu-go/gotwant"
+	"github.com/shu-go/rng"
+	"github.com/shu-go/wfw/wfw"
+)
+
+func TestParseIPRange(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want rng.Range
+	}{
+		{"192.168.0.1", rng.NewRange(rng.IPv4{192, 168, 0, 1}, rng.IPv4{192, 168, 0, 1})},
+		{" 192.168.0.1 - 192.168.0.100 ", rng.NewRange(rng.IPv4{192, 168, 0, 1}, rng.IPv4{192, 168, 0, 100})},
+		{"10.0.0.0/8", rng.NewRange(rng.IPv4{10, 0, 0, 0}, rng.IPv4{10, 255, 255, 255})},
+		{"192.168.1.77/24", rng.NewRange(rng.IPv4{192, 168, 1, 0}, rng.IPv4{192, 168, 1, 255})},
+		{"0.0.0.0/0", rng.NewRange(rng.IPv4{0, 0, 0, 0}, rng.IPv4{255, 255, 255, 255})},
+		{"fd00::/120", rng.NewRange(wfw.NewIPv6("fd00::"), wfw.NewIPv6("fd00::ff"))},
+	} {
+		got, err := parseIPRange(c.s)
+		if err != nil {
+			t.Fatalf("%q: %v", c.s, err)
+		}
+		gotwant.Test(t, got, c.want)
+	}
+
+	for _, s := range []string{
+		"10.0.0.0/33",
+		"10.0.0.0/",
+		"10.0.0/8",
+		"192.168.0.100-192.168.0.1",
+		"192.168.0.1-fd00::1",
+		"",
+	} {
+		_, err := parseIPRange(s)
+		if err == nil {
+			t.Errorf("%q must be an error", s)
+		}
+	}
+}
+
+func TestCIDRsFromRange(t *testing.T) {
+	for _, c := range []struct {
+		r    rng.Range
+		want []string
+	}{
+		{rng.NewRange(rng.IPv4{192, 168, 0, 1}, rng.IPv4{192, 168, 0, 1}), []string{"192.168.0.1/32"}},
+		{rng.NewRange(rng.IPv4{10, 0, 0, 0}, rng.IPv4{10, 255, 255, 255}), []string{"10.0.0.0/8"}},
+		{rng.NewRange(rng.IPv4{0, 0, 0, 0}, rng.IPv4{255, 255, 255, 255}), []string{"0.0.0.0/0"}},
+		{rng.NewRange(rng.IPv4{192, 168, 0, 1}, rng.IPv4{192, 168, 0, 100}), []string{
+			"192.168.0.1/32",
+			"192.168.0.2/31",
+			"192.168.0.4/30",
+			"192.168.0.8/29",
+			"192.168.0.16/28",
+			"192.168.0.32/27",
+			"192.168.0.64/27",
+			"192.168.0.96/30",
+			"192.168.0.100/32",
+		}},
+		{rng.NewRange(wfw.NewIPv6("fd00::"), wfw.NewIPv6("fd00::1ff")), []string{"fd00::/119"}},
+		{rng.NewRange(wfw.NewIPv6("::"), wfw.NewIPv6("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")), []string{"::/0"}},
+	} {
+		gotwant.Test(t, cidrsFromRange(c.r), c.want)
+	}
+
+	t.Run("Host", func(t *testing.T) {
+		gotwant.Test(t, trimHostPrefix("192.168.0.1/32"), "192.168.0.1")
+		gotwant.Test(t, trimHostPrefix("fd00::1/128"), "fd00::1")
+		// a /32 of IPv6 is not a single address
+		gotwant.Test(t, trimHostPrefix("fd00::/32"), "fd00::/32")
+		gotwant.Test(t, trimHostPrefix("10.0.0.0/8"), "10.0.0.0/8")
+	})
+}
+
+func TestJoinRuleIFs(t *testing.T) {
+	// protocols are case-insensitive
+	ruleIFs := []RuleIF{
+		{Name: "web", Allow: true, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "80", IPs: "10.0.0.1"},
+		{Name: "web", Allow: true, Direction: "in", Profile: "any", Protocol: "tcp", Ports: "80", IPs: "10.0.0.2"},
+		{Name: "web", Allow: true, Direction: "in", Profile: "any", Protocol: "Tcp", Ports: "443", IPs: "10.0.0.1"},
+	}
+	got := joinRuleIFs(ruleIFs, "ip")
+	gotwant.Test(t, len(got), 2)
+	gotwant.Test(t, got[0].IPs, "10.0.0.1")
+	gotwant.Test(t, got[0].Ports, "80,443")
+
+	got = joinRuleIFs(ruleIFs, "port")
+	gotwant.Test(t, len(got), 2)
+	gotwant.Test(t, got[0].IPs, "10.0.0.1,10.0.0.2")
+	gotwant.Test(t, got[0].Ports, "80")
+}
+
+func TestPSQuote(t *testing.T) {
+	gotwant.Test(t, psQuote("allow HTTPS"), "'allow HTTPS'")
+	gotwant.Test(t, psQuote("it's"), "'it''s'")
+	gotwant.Test(t, psQuote("it’s"), "'it’’s'")
+	gotwant.Test(t, psQuote("$env:PATH `n"), "'$env:PATH `n'")
+	gotwant.Test(t, psArray("0-79, 81-442"), "'0-79','81-442'")
+}
+
+func TestWriteRules(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		rif             RuleIF
+		cmd, powershell string
+	}{
+		{
+			name:       "inbound",
+			rif:        RuleIF{Name: "allow web", Desc: "from the office", Allow: true, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "80,443", IPs: "10.0.0.1-10.0.0.9"},
+			cmd:        `netsh advfirewall firewall add rule  name="allow web"  enable=no  description="from the office"  dir=in  profile=any  action=allow  protocol="tcp"  localport="80,443"  remoteip="10.0.0.1-10.0.0.9"`,
+			powershell: `New-NetFirewallRule  -DisplayName 'allow web'  -Enabled False  -Description 'from the office'  -Direction Inbound  -Profile Any  -Action Allow  -Protocol 'TCP'  -LocalPort '80','443'  -RemoteAddress '10.0.0.1-10.0.0.9'`,
+		},
+		{
+			name:       "outbound",
+			rif:        RuleIF{Name: "allow DNS", Allow: true, Direction: "out", Profile: "any", Protocol: "UDP", Ports: "0-65535", IPs: "10.0.0.53"},
+			cmd:        `netsh advfirewall firewall add rule  name="allow DNS"  enable=no    dir=out  profile=any  action=allow  protocol="udp"  localport="0-65535"  remoteip="10.0.0.53"`,
+			powershell: `New-NetFirewallRule  -DisplayName 'allow DNS'  -Enabled False    -Direction Outbound  -Profile Any  -Action Allow  -Protocol 'UDP'  -LocalPort '0-65535'  -RemoteAddress '10.0.0.53'`,
+		},
+		{
+			name:       "profile",
+			rif:        RuleIF{Name: "block ping", Allow: false, Direction: "in", Profile: "private,public", Protocol: "ICMPv4", Ports: "0-65535", IPs: "0.0.0.0-255.255.255.255"},
+			cmd:        `netsh advfirewall firewall add rule  name="block ping"  enable=no    dir=in  profile=private,public  action=block  protocol="icmpv4"    remoteip="0.0.0.0-255.255.255.255"`,
+			powershell: `New-NetFirewallRule  -DisplayName 'block ping'  -Enabled False    -Direction Inbound  -Profile 'private','public'  -Action Block  -Protocol 'ICMPv4'    -RemoteAddress '0.0.0.0-255.255.255.255'`,
+		},
+		{
+			name:       "remote port and local IP",
+			rif:        RuleIF{Name: "allow NTP", Allow: true, Direction: "in", Profile: "any", Protocol: "UDP", Ports: "0-65535", IPs: "10.0.0.123", RemotePorts: "123", LocalIPs: "10.0.0.1,10.0.0.2"},
+			cmd:        `netsh advfirewall firewall add rule  name="allow NTP"  enable=no    dir=in  profile=any  action=allow  protocol="udp"  localport="0-65535"  remoteip="10.0.0.123"  remoteport="123"  localip="10.0.0.1,10.0.0.2"`,
+			powershell: `New-NetFirewallRule  -DisplayName 'allow NTP'  -Enabled False    -Direction Inbound  -Profile Any  -Action Allow  -Protocol 'UDP'  -LocalPort '0-65535'  -RemoteAddress '10.0.0.123'  -RemotePort '123'  -LocalAddress '10.0.0.1','10.0.0.2'`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, f := range []struct{ format, want string }{{"cmd", tc.cmd}, {"powershell", tc.powershell}} {
+				var sb strings.Builder
+				if err := (globalCmd{Format: f.format}).writeRules(&sb, []RuleIF{tc.rif}); err != nil {
+					t.Fatal(err)
+				}
+				gotwant.Test(t, sb.String(), f.want+"\r\n")
+			}
+		})
+	}
+}
+
+func TestGroup(t *testing.T) {
+	inRuleIFs := []RuleIF{
+		{Name: "allow web", Group: "Web", Allow: true, Protocol: "TCP", Ports: "80", IPs: "10.0.0.0/8"},
+		{Name: "block all", Allow: false, Protocol: "TCP", Ports: "0-65535", IPs: "10.0.0.0/8"},
+	}
+	output := func(c globalCmd) []string {
+		in := append([]RuleIF{}, inRuleIFs...)
+		for i := range in {
+			in[i].tag = i
+		}
+		c.Input, c.Aggregation, c.IPStyle, c.Except, c.Model = "rules.json", "ip", "range", "(Except: %)", "first-match"
+		ruleIFs, _, err := c.generate(in, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sb strings.Builder
+		if err := c.writeRules(&sb, ruleIFs); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSuffix(sb.String(), "\r\n"), "\r\n")
+	}
+
+	t.Run("PowerShell", func(t *testing.T) {
+		lines := output(globalCmd{Format: "powershell"})
+		gotwant.Test(t, len(lines), 2)
+		gotwant.Test(t, strings.Contains(lines[0], "  -Group 'Web'  "), true)
+		// defaults to the name of the input file
+		gotwant.Test(t, strings.Contains(lines[1], "  -Group 'rules'  "), true)
+	})
+
+	t.Run("Cmd", func(t *testing.T) {
+		// of the rules named by --replace, including the default group
+		lines := output(globalCmd{Format: "cmd", Replace: "wfw"})
+		gotwant.Test(t, len(lines), 5)
+		gotwant.Test(t, lines[3], `powershell -NoProfile -Command "Get-NetFirewallRule -DisplayName 'wfw: allow web' | ForEach-Object { $_.Group = 'Web'; $_ | Set-NetFirewallRule }"`)
+		gotwant.Test(t, lines[4], `powershell -NoProfile -Command "Get-NetFirewallRule -DisplayName 'wfw: block all(Except: allow web)' | ForEach-Object { $_.Group = 'rules'; $_ | Set-NetFirewallRule }"`)
+
+		lines = output(globalCmd{Format: "cmd", Replace: "wfw", Group: "Office"})
+		gotwant.Test(t, len(lines), 5)
+		gotwant.Test(t, lines[3], `powershell -NoProfile -Command "Get-NetFirewallRule -DisplayName 'wfw: allow web' | ForEach-Object { $_.Group = 'Web'; $_ | Set-NetFirewallRule }"`)
+		gotwant.Test(t, lines[4], `powershell -NoProfile -Command "Get-NetFirewallRule -DisplayName 'wfw: block all(Except: allow web)' | ForEach-Object { $_.Group = 'Office'; $_ | Set-NetFirewallRule }"`)
+
+		// without --replace, the names may match other rules of the host
+		lines = output(globalCmd{Format: "cmd"})
+		gotwant.Test(t, len(lines), 2)
+		for _, l := range lines {
+			gotwant.Test(t, strings.HasPrefix(l, "netsh "), true)
+		}
+	})
+
+	t.Run("CmdLineLength", func(t *testing.T) {
+		// the names of a group are split into lines cmd.exe accepts
+		var ruleIFs []RuleIF
+		for i := 0; i < 1000; i++ {
+			ruleIFs = append(ruleIFs, RuleIF{Name: fmt.Sprintf("allow host %d", i), Group: "Hosts", Allow: true, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "80", IPs: "10.0.0.1"})
+		}
+		var sb strings.Builder
+		if err := (globalCmd{Format: "cmd", Replace: "wfw"}).writeRules(&sb, ruleIFs); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(sb.String(), "\r\n"), "\r\n")
+
+		names := 0
+		groupLines := 0
+		for _, l := range lines[1+len(ruleIFs):] {
+			groupLines++
+			if len(l) > cmdLineMax {
+				t.Errorf("%d chars", len(l))
+			}
+			names += strings.Count(l, "'wfw: allow host ")
+		}
+		gotwant.Test(t, names, len(ruleIFs))
+		gotwant.Test(t, groupLines > 1, true)
+	})
+}
+
+func TestReplace(t *testing.T) {
+	ruleIFs := []RuleIF{
+		{Name: "allow web [80]", Group: "Web", Allow: true, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "80", IPs: "10.0.0.0/8"},
+	}
+	output := func(format string) []string {
+		var sb strings.Builder
+		c := globalCmd{Format: format, Replace: "wfw"}
+		if err := c.writeRules(&sb, append([]RuleIF{}, ruleIFs...)); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSuffix(sb.String(), "\r\n"), "\r\n")
+	}
+
+	t.Run("Cmd", func(t *testing.T) {
+		lines := output("cmd")
+		gotwant.Test(t, len(lines), 3)
+		// deletes the rules of the previous run first
+		gotwant.Test(t, lines[0], `powershell -NoProfile -Command "Get-NetFirewallRule -DisplayName 'wfw: *' -ErrorAction SilentlyContinue | Remove-NetFirewallRule"`)
+		gotwant.Test(t, strings.HasPrefix(lines[1], `netsh advfirewall firewall add rule  name="wfw: allow web [80]"  `), true)
+		// the name is matched literally
+		gotwant.Test(t, lines[2], "powershell -NoProfile -Command \"Get-NetFirewallRule -DisplayName 'wfw: allow web `[80`]' | ForEach-Object { $_.Group = 'Web'; $_ | Set-NetFirewallRule }\"")
+	})
+
+	t.Run("PowerShell", func(t *testing.T) {
+		lines := output("powershell")
+		gotwant.Test(t, len(lines), 2)
+		gotwant.Test(t, lines[0], `Get-NetFirewallRule -DisplayName 'wfw: *' -ErrorAction SilentlyContinue | Remove-NetFirewallRule`)
+		gotwant.Test(t, strings.HasPrefix(lines[1], `New-NetFirewallRule  -DisplayName 'wfw: allow web [80]'  -Group 'Web'  `), true)
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		// wildcards would delete other rules, and the others break quoting in a batch file
+		for _, replace := range []string{"wfw*", "wfw?", "[wfw]", `"wfw"`, "%wfw%"} {
+			c := globalCmd{
+				Input:       "no such file.json",
+				Aggregation: "ip",
+				Format:      "cmd",
+				Replace:     replace,
+				IPStyle:     "range",
+				Model:       "first-match",
+				HostProfile: "public",
+				Chain:       "wfw",
+			}
+			err := c.Run(nil)
+			if err == nil || !strings.HasPrefix(err.Error(), "--replace") {
+				t.Errorf("%s: got %v", replace, err)
+			}
+		}
+	})
+}
+
+func TestGenerateVerify(t *testing.T) {
+	inRuleIFs := []RuleIF{
+		{Name: "allow HTTPS", Allow: true, Protocol: "TCP", Ports: "443", IPs: "192.168.0.0/16"},
+		{Name: "allow from .0.101", Allow: true, Protocol: "TCP", Ports: "80,443,8080", IPs: "192.168.0.101"},
+		{Name: "allow DNS", Allow: true, Direction: "out", Protocol: "UDP", Ports: "0-65535", IPs: "10.0.0.53", RemotePorts: "53"},
+		{Name: "deny TCP", Allow: false, Profile: "public", Protocol: "TCP", Ports: "0-65535", IPs: "192.168.0.0/16,fd00::/8"},
+		{Name: "deny UDP", Allow: false, Direction: "out", Protocol: "UDP", Ports: "0-65535", IPs: "0.0.0.0/0"},
+		{Name: "allow RDP", Allow: true, Protocol: "TCP", Ports: "3389", IPs: "192.168.0.101", LocalIPs: "192.168.0.1-192.168.0.10"},
+	}
+	for i := range inRuleIFs {
+		inRuleIFs[i].tag = i
+	}
+
+	for _, c := range []globalCmd{
+		{Aggregation: "ip", IPStyle: "range", Except: "(Except: %)"},
+		{Aggregation: "port", IPStyle: "range", Except: "(Except: %)"},
+		{Aggregation: "ip", IPStyle: "cidr", Except: "(Except: %)"},
+		{Aggregation: "port", IPStyle: "cidr", Except: "(Except: %)"},
+	} {
+		ruleIFs, inRS, err := c.generate(inRuleIFs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outRS, err := ruleSetFromRuleIFs(ruleIFs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ce := wfw.Verify(inRS, outRS, wfw.Dimensions(c.Aggregation == "port")); ce != nil {
+			t.Errorf("%s/%s: %s", c.Aggregation, c.IPStyle, describeCounterexample(ce))
+		}
+	}
+}
+
+func TestRuleID(t *testing.T) {
+	inRuleIFs := []RuleIF{
+		{Name: "allow HTTPS", Allow: true, Protocol: "TCP", Ports: "443", IPs: "192.168.0.0/16"},
+		{Name: "deny TCP", Allow: false, Protocol: "TCP", Ports: "0-65535", IPs: "192.168.0.0/16"},
+		{Name: "deny UDP", Allow: false, Protocol: "UDP", Ports: "0-65535", IPs: "192.168.0.0/16"},
+	}
+	ids := func(c globalCmd, inRuleIFs []RuleIF) map[string]bool {
+		for i := range inRuleIFs {
+			inRuleIFs[i].tag = i
+		}
+		c.Aggregation, c.ID = "ip", " #%"
+		ruleIFs, _, err := c.generate(inRuleIFs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make(map[string]bool)
+		for _, rif := range ruleIFs {
+			ids[rif.Name[strings.LastIndex(rif.Name, " #")+2:]] = true
+		}
+		return ids
+	}
+
+	base := ids(globalCmd{IPStyle: "range"}, append([]RuleIF{}, inRuleIFs...))
+	gotwant.Test(t, len(base), 3)
+
+	gotwant.Test(t, ids(globalCmd{IPStyle: "cidr"}, append([]RuleIF{}, inRuleIFs...)), base)
+
+	// editing UDP does not change the others
+	edited := append([]RuleIF{}, inRuleIFs...)
+	edited[2].Ports = "0-1023"
+	got := ids(globalCmd{IPStyle: "range"}, edited)
+	gotwant.Test(t, len(got), 3)
+	common := 0
+	for id := range got {
+		if base[id] {
+			common++
+		}
+	}
+	gotwant.Test(t, common, 2)
+
+	t.Run("Unrelated", func(t *testing.T) {
+		inRuleIFs := []RuleIF{
+			{Name: "allow office", Allow: true, Protocol: "TCP", Ports: "80", IPs: "10.0.0.0/8"},
+			{Name: "allow lab", Allow: true, Protocol: "TCP", Ports: "80", IPs: "172.16.0.0/12"},
+		}
+		idOf := func(inRuleIFs []RuleIF, name string) string {
+			for i := range inRuleIFs {
+				inRuleIFs[i].tag = i
+			}
+			c := globalCmd{Aggregation: "ip", IPStyle: "range", ID: " #%"}
+			ruleIFs, _, err := c.generate(inRuleIFs, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rif := range ruleIFs {
+				if n, id, found := strings.Cut(rif.Name, " #"); found && n == name {
+					return id
+				}
+			}
+			t.Fatalf("no rule named %s", name)
+			return ""
+		}
+
+		base := idOf(append([]RuleIF{}, inRuleIFs...), "allow office")
+
+		// the lab shares the protocol and the ports, but not the IPs of the office
+		edited := append([]RuleIF{}, inRuleIFs...)
+		edited[1].IPs = "192.168.0.0/16"
+		gotwant.Test(t, idOf(edited, "allow office"), base)
+		gotwant.Test(t, idOf(edited, "allow lab") != idOf(append([]RuleIF{}, inRuleIFs...), "allow lab"), true)
+	})
+}
+
+const netshDump = "\ufeff" + `
+Rule Name:                            Remote Desktop
+----------------------------------------------------------------------
+Description:                          allows RDP from the office
+Enabled:                              Yes
+Direction:                            In
+Profiles:                             Domain,Private
+Grouping:                             Remote Desktop
+LocalIP:                              Any
+RemoteIP:                             192.168.0.0/255.255.255.0,10.0.0.1-10.0.0.9
+Protocol:                             TCP
+LocalPort:                            3389
+RemotePort:                           Any
+Edge traversal:                       No
+InterfaceTypes:                       Any
+Security:                             NotRequired
+Rule source:                          Local Setting
+Action:                               Allow
+
+Rule Name:                            block SMB
+----------------------------------------------------------------------
+Enabled:                              No
+Direction:                            In
+Profiles:                             Domain,Private,Public
+Grouping:
+LocalIP:                              Any
+RemoteIP:                             Any
+Protocol:                             TCP
+LocalPort:                            139,445
+RemotePort:                           Any
+Edge traversal:                       No
+Action:                               Block
+
+Rule Name:                            ping
+----------------------------------------------------------------------
+Enabled:                              Yes
+Direction:                            In
+Profiles:                             Domain,Private,Public
+LocalIP:                              Any
+RemoteIP:                             LocalSubnet
+Protocol:                             ICMPv4
+                                      Type    Code
+                                      8       Any
+Action:                               Allow
+
+Rule Name:                            app
+----------------------------------------------------------------------
+Enabled:                              Yes
+Direction:                            Out
+Profiles:                             Public
+Program:                              C:\app.exe
+Protocol:                             UDP
+Action:                               Allow
+Ok.
+
+`
+
+func TestImportNetsh(t *testing.T) {
+	text, err := readText(strings.NewReader(strings.ReplaceAll(netshDump, "\n", "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := parseNetsh(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ruleIFs, notes := importRecords(recs, ruleIFFromNetsh)
+
+	gotwant.Test(t, len(notes), 2)
+	gotwant.Test(t, ruleIFs, []RuleIF{
+		{
+			Name:      "#block SMB",
+			Allow:     false,
+			Direction: "in",
+			Profile:   "any",
+			Protocol:  "tcp",
+			Ports:     "139,445",
+			IPs:       "0.0.0.0/0,::/0",
+		},
+		{
+			Name:      "Remote Desktop",
+			Desc:      "allows RDP from the office",
+			Group:     "Remote Desktop",
+			Allow:     true,
+			Direction: "in",
+			Profile:   "domain,private",
+			Protocol:  "tcp",
+			Ports:     "3389",
+			IPs:       "192.168.0.0/24,10.0.0.1-10.0.0.9",
+		},
+	})
+
+	if _, err := ruleSetFromRuleIFs(ruleIFs); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImportPS(t *testing.T) {
+	want := []RuleIF{
+		{
+			Name:        "block Telnet",
+			Allow:       false,
+			Direction:   "out",
+			Profile:     "public",
+			Protocol:    "tcp",
+			Ports:       "0-65535",
+			IPs:         "0.0.0.0/0,::/0",
+			RemotePorts: "23",
+		},
+		{
+			Name:      "#Web",
+			Desc:      "web server",
+			Group:     "Web",
+			Allow:     true,
+			Direction: "in",
+			Profile:   "domain,private",
+			Protocol:  "tcp",
+			Ports:     "80,443",
+			IPs:       "LocalSubnet,10.0.0.0/8",
+		},
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		recs, err := parsePSJSON(`[
+  {"DisplayName": "Web", "Description": "web server", "DisplayGroup": "Web", "Enabled": 1, "Direction": 1, "Profile": 3, "Action": 2,
+   "Protocol": "TCP", "LocalPort": ["80", "443"], "RemotePort": "Any", "LocalAddress": "Any", "RemoteAddress": ["LocalSubnet", "10.0.0.0/255.0.0.0"]},
+  {"DisplayName": "block Telnet", "Enabled": 1, "Direction": 2, "Profile": 4, "Action": 4,
+   "Protocol": "TCP", "LocalPort": "Any", "RemotePort": "23", "LocalAddress": "Any", "RemoteAddress": "Any"},
+  {"DisplayName": "app", "Enabled": 1, "Direction": 1, "Profile": 0, "Action": 2, "Program": "C:\\app.exe"}
+]`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ruleIFs, notes := importRecords(recs, ruleIFFromPS)
+		gotwant.Test(t, len(notes), 2)
+		gotwant.Test(t, ruleIFs, want)
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		recs, err := parsePSCSV(`#TYPE System.Management.Automation.PSCustomObject
+"DisplayName","Description","DisplayGroup","Enabled","Direction","Profile","Action","Protocol","LocalPort","RemotePort","LocalAddress","RemoteAddress"
+"Web","web server","Web","True","Inbound","Domain, Private","Allow","TCP","80,443","Any","Any","LocalSubnet,10.0.0.0/255.0.0.0"
+"block Telnet","","","True","Outbound","Public","Block","TCP","Any","23","Any","Any"
+"array","","","True","Inbound","Any","Allow","TCP","System.Object[]","Any","Any","Any"
+`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ruleIFs, notes := importRecords(recs, ruleIFFromPS)
+		gotwant.Test(t, len(notes), 2)
+		gotwant.Test(t, ruleIFs, want)
+	})
+}
+
+func TestQuery(t *testing.T) {
+	file := RuleFileIF{
+		Defaults: []DefaultIF{{Protocol: "TCP", Allow: false}},
+		Rules: []RuleIF{
+			{Name: "block SMB", Allow: false, Protocol: "TCP", Ports: "445", IPs: "0.0.0.0/0"},
+			{Name: "allow office", Allow: true, Profile: "domain", Protocol: "TCP", Ports: "0-65535", IPs: "10.0.0.0/8"},
+		},
+	}
+	for i := range file.Rules {
+		file.Rules[i].tag = i
+	}
+	g := &globalCmd{Aggregation: "ip", IPStyle: "range", Except: "(Except: %)", Model: "first-match", FillGaps: true}
+
+	query := func(q queryCmd) string {
+		packet, err := q.packet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sb strings.Builder
+		if err := q.query(&sb, g, packet, file); err != nil {
+			t.Fatal(err)
+		}
+		return sb.String()
+	}
+
+	// the default decides where no rule matches
+	gotwant.Test(t, query(queryCmd{Direction: "in", Profile: "domain,public", Protocol: "tcp", Port: "80", IP: "10.0.0.1"}), `----------------------------------------
+Profile: domain
+Action: allow
+Input: [1] allow office
+Output: [1] allow office(Except: block SMB)
+----------------------------------------
+Profile: public
+Action: BLOCK
+Input: [2] default block in tcp
+Output: [2] default block in tcp
+`)
+
+	gotwant.Test(t, query(queryCmd{Direction: "in", Profile: "domain", Protocol: "tcp", Port: "445", IP: "10.0.0.1"}), `----------------------------------------
+Profile: domain
+Action: BLOCK
+Input: [0] block SMB
+Output: [0] block SMB
+`)
+
+	// without --fill-gaps, no output rule implements the default
+	g.FillGaps = false
+	gotwant.Test(t, query(queryCmd{Direction: "in", Profile: "public", Protocol: "tcp", Port: "80", IP: "10.0.0.1"}), `----------------------------------------
+Profile: public
+Action: BLOCK
+Input: [2] default block in tcp
+Output: -
+`)
+
+	// any covers TCP
+	file.Rules = append([]RuleIF{{Name: "allow any", Allow: true, Protocol: "any", Ports: "0-65535", IPs: "10.0.0.2"}}, file.Rules...)
+	for i := range file.Rules {
+		file.Rules[i].tag = i
+	}
+	gotwant.Test(t, query(queryCmd{Direction: "in", Profile: "domain", Protocol: "tcp", Port: "445", IP: "10.0.0.2"}), `----------------------------------------
+Profile: domain
+Action: allow
+Input: [0] allow any
+Output: [0] allow any
+`)
+}
+
+func TestDiffDefaults(t *testing.T) {
+	file := func(allow bool) RuleFileIF {
+		return RuleFileIF{
+			Defaults: []DefaultIF{{Protocol: "TCP", Allow: allow}},
+			Rules: []RuleIF{
+				{Name: "block SMB", Allow: false, Protocol: "TCP", Ports: "445", IPs: "10.0.0.0/8"},
+			},
+		}
+	}
+	diff := func(files [2]RuleFileIF) string {
+		g := &globalCmd{Aggregation: "ip", IPStyle: "cidr", Model: "first-match"}
+		var sb strings.Builder
+		if err := (diffCmd{}).diff(&sb, g, files); err != nil {
+			t.Fatal(err)
+		}
+		return sb.String()
+	}
+
+	gotwant.Test(t, diff([2]RuleFileIF{file(true), file(true)}), "no changes\n")
+
+	// only the default changes from allow to block
+	gotwant.Test(t, diff([2]RuleFileIF{file(true), file(false)}), `== in TCP IPv4
+newly blocked (was allow): profile=any  localport=0-65535  remoteip=0.0.0.0/5,8.0.0.0/7
+newly blocked (was allow): profile=any  localport=0-444  remoteip=10.0.0.0/8
+newly blocked (was allow): profile=any  localport=446-65535  remoteip=10.0.0.0/8
+newly blocked (was allow): profile=any  localport=0-65535  remoteip=11.0.0.0/8,12.0.0.0/6,16.0.0.0/4,32.0.0.0/3,64.0.0.0/2,128.0.0.0/1
+== in TCP IPv6
+newly blocked (was allow): profile=any  localport=0-65535  remoteip=::/0
+`)
+}
+
+func TestFillGaps(t *testing.T) {
+	inRuleIFs := []RuleIF{
+		{Name: "allow web", Allow: true, Protocol: "TCP", Ports: "80,443", IPs: "0.0.0.0/0"},
+		{Name: "block SMB", Allow: false, Protocol: "TCP", Ports: "445", IPs: "10.0.0.0/8"},
+	}
+	defaults := []DefaultIF{{Protocol: "tcp", Allow: false}}
+
+	c := globalCmd{Aggregation: "ip", IPStyle: "range", Except: "(Except: %)", FillGaps: true}
+	ruleIFs, inRS, err := c.generate(inRuleIFs, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outRS, err := ruleSetFromRuleIFs(ruleIFs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ce := wfw.Verify(inRS, outRS, wfw.Dimensions(false)); ce != nil {
+		t.Error(describeCounterexample(ce))
+	}
+
+	// the default rule shares the space of the rules
+	packet := wfw.Rule{
+		Direction: "in",
+		Protocol:  "TCP",
+		Port:      rng.NewRange(rng.Int(22), rng.Int(22)),
+		IP:        rng.NewRange(rng.IPv4{192, 168, 0, 1}, rng.IPv4{192, 168, 0, 1}),
+	}
+	out := outRS.BlockWins(packet)
+	gotwant.Test(t, out >= 0, true)
+	gotwant.Test(t, outRS[out].Allow, false)
+	gotwant.Test(t, strings.HasPrefix(outRS[out].Name, "default block in tcp"), true)
+
+	packet.IP = rng.NewRange(wfw.NewIPv6("fd00::1"), wfw.NewIPv6("fd00::1"))
+	gotwant.Test(t, outRS.BlockWins(packet) >= 0, true)
+
+	c.FillGaps = false
+	ruleIFs, _, err = c.generate(inRuleIFs, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotwant.Test(t, len(ruleIFs), 2)
+}
+
+// generatedRuleIFs returns the output of generate for an allow rule of the domain profile cut out of a block rule,
+// followed by an allow rule of the private profile overlapping the block rule.
+func generatedRuleIFs(t *testing.T) []RuleIF {
+	t.Helper()
+
+	inRuleIFs := []RuleIF{
+		{Name: "allow admin", Allow: true, Direction: "in", Profile: "domain", Protocol: "TCP", Ports: "22", IPs: "10.0.0.5"},
+		{Name: "block LAN", Allow: false, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "0-65535", IPs: "10.0.0.0/24"},
+		{Name: "allow web", Allow: true, Direction: "in", Profile: "private", Protocol: "TCP", Ports: "80", IPs: "10.0.0.0/23"},
+	}
+	c := globalCmd{Aggregation: "ip", IPStyle: "range", Except: "(Except: %)"}
+	ruleIFs, _, err := c.generate(inRuleIFs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ruleIFs
+}
+
+func TestIPTables(t *testing.T) {
+	ruleIFs := []RuleIF{
+		{Name: "allow \"web\"", Allow: true, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "443", IPs: "192.168.0.0/16,10.0.0.1-10.0.0.9"},
+		{Name: "allow DNS", Allow: true, Direction: "out", Profile: "public", Protocol: "UDP", Ports: "0-65535", IPs: "10.0.0.53", RemotePorts: "53"},
+		{Name: "block domain", Allow: false, Direction: "in", Profile: "domain", Protocol: "TCP", Ports: "0-65535", IPs: "0.0.0.0/0"},
+		{Name: "block v6", Allow: false, Direction: "in", Profile: "any", Protocol: "any", Ports: "0-65535", IPs: "fd00::/8", LocalIPs: "fd00::1"},
+	}
+
+	rs, err := hostRules(ruleIFs, wfw.ProfilePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotwant.Test(t, countFamily(rs, 6), 1)
+
+	var sb strings.Builder
+	writeIPTables(&sb, rs, 4, "wfw", "test.json")
+	_, body, _ := strings.Cut(sb.String(), "*filter\n")
+	gotwant.Test(t, body, `:wfw-in - [0:0]
+:wfw-out - [0:0]
+-A wfw-in -p tcp --dport 443 -s 192.168.0.0/16 -m comment --comment "allow 'web'" -j ACCEPT
+-A wfw-in -p tcp --dport 443 -m iprange --src-range 10.0.0.1-10.0.0.9 -m comment --comment "allow 'web'" -j ACCEPT
+-A wfw-out -p udp --dport 53 -d 10.0.0.53 -m comment --comment "allow DNS" -j ACCEPT
+COMMIT
+`)
+
+	sb.Reset()
+	writeIPTables(&sb, rs, 6, "wfw", "test.json")
+	_, body, _ = strings.Cut(sb.String(), "*filter\n")
+	gotwant.Test(t, body, `:wfw-in - [0:0]
+:wfw-out - [0:0]
+-A wfw-in -s fd00::/8 -d fd00::1 -m comment --comment "block v6" -j DROP
+COMMIT
+`)
+
+	t.Run("Generated", func(t *testing.T) {
+		rs, err := hostRules(generatedRuleIFs(t), wfw.ProfilePrivate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sb strings.Builder
+		writeIPTables(&sb, rs, 4, "wfw", "test.json")
+		_, body, _ := strings.Cut(sb.String(), "*filter\n")
+		gotwant.Test(t, body, `:wfw-in - [0:0]
+:wfw-out - [0:0]
+-A wfw-in -p tcp --dport 0:21 -s 10.0.0.5 -m comment --comment "block LAN(Except: allow admin)" -j DROP
+-A wfw-in -p tcp --dport 23:65535 -s 10.0.0.5 -m comment --comment "block LAN(Except: allow admin)" -j DROP
+-A wfw-in -p tcp -m iprange --src-range 10.0.0.0-10.0.0.4 -m comment --comment "block LAN(Except: allow admin)" -j DROP
+-A wfw-in -p tcp -m iprange --src-range 10.0.0.6-10.0.0.255 -m comment --comment "block LAN(Except: allow admin)" -j DROP
+-A wfw-in -p tcp --dport 22 -s 10.0.0.5 -m comment --comment "block LAN(Except: allow admin)" -j DROP
+-A wfw-in -p tcp --dport 80 -s 10.0.1.0/24 -m comment --comment "allow web" -j ACCEPT
+COMMIT
+`)
+	})
+}
+
+func TestNft(t *testing.T) {
+	ruleIFs := []RuleIF{
+		{Name: "allow web", Allow: true, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "80,443", IPs: "192.168.0.0/16,10.0.0.1-10.0.0.9,fd00::/8"},
+		{Name: "allow DNS", Allow: true, Direction: "out", Profile: "public", Protocol: "UDP", Ports: "0-65535", IPs: "10.0.0.53", RemotePorts: "53"},
+		{Name: "block domain", Allow: false, Direction: "in", Profile: "domain", Protocol: "TCP", Ports: "0-65535", IPs: "0.0.0.0/0"},
+		{Name: "block v6", Allow: false, Direction: "in", Profile: "any", Protocol: "any", Ports: "0-65535", IPs: "::/0"},
+	}
+
+	var sb strings.Builder
+	if err := writeNft(&sb, ruleIFs, wfw.ProfilePublic, "wfw", "test.json"); err != nil {
+		t.Fatal(err)
+	}
+	_, body, _ := strings.Cut(sb.String(), "delete table inet wfw\n")
+	gotwant.Test(t, body, `table inet wfw {
+	set r0_remoteip4 {
+		type ipv4_addr
+		flags interval
+		auto-merge
+		elements = { 192.168.0.0/16, 10.0.0.1-10.0.0.9 }
+	}
+	set r0_port {
+		type inet_service
+		flags interval
+		auto-merge
+		elements = { 80, 443 }
+	}
+	chain wfw-in {
+		type filter hook input priority 0; policy accept;
+		meta nfproto ipv6 drop comment "block v6"
+		meta l4proto tcp ip saddr @r0_remoteip4 tcp dport @r0_port accept comment "allow web"
+		meta l4proto tcp ip6 saddr fd00::/8 tcp dport @r0_port accept comment "allow web"
+	}
+	chain wfw-out {
+		type filter hook output priority 0; policy accept;
+		meta l4proto udp ip daddr 10.0.0.53 udp dport 53 accept comment "allow DNS"
+	}
+}
+`)
+
+	t.Run("Generated", func(t *testing.T) {
+		var sb strings.Builder
+		if err := writeNft(&sb, generatedRuleIFs(t), wfw.ProfilePrivate, "wfw", "test.json"); err != nil {
+			t.Fatal(err)
+		}
+		_, body, _ := strings.Cut(sb.String(), "delete table inet wfw\n")
+		gotwant.Test(t, body, `table inet wfw {
+	set r0_port {
+		type inet_service
+		flags interval
+		auto-merge
+		elements = { 0-21, 23-65535 }
+	}
+	set r1_remoteip4 {
+		type ipv4_addr
+		flags interval
+		auto-merge
+		elements = { 10.0.0.0-10.0.0.4, 10.0.0.6-10.0.0.255 }
+	}
+	chain wfw-in {
+		type filter hook input priority 0; policy accept;
+		meta l4proto tcp ip saddr 10.0.0.5 tcp dport @r0_port drop comment "block LAN(Except: allow admin)"
+		meta l4proto tcp ip saddr @r1_remoteip4 drop comment "block LAN(Except: allow admin)"
+		meta l4proto tcp ip saddr 10.0.0.5 tcp dport 22 drop comment "block LAN(Except: allow admin)"
+		meta l4proto tcp ip saddr 10.0.1.0-10.0.1.255 tcp dport 80 accept comment "allow web"
+	}
+	chain wfw-out {
+		type filter hook output priority 0; policy accept;
+	}
+}
+`)
+	})
+}
+
+func TestPF(t *testing.T) {
+	ruleIFs := []RuleIF{
+		{Name: "allow web", Allow: true, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "80,443", IPs: "10.0.0.0/24,10.0.1.0-10.0.1.1,fd00::/8"},
+		{Name: "allow DNS", Allow: true, Direction: "out", Profile: "public", Protocol: "UDP", Ports: "0-65535", IPs: "10.0.0.53", RemotePorts: "53"},
+		{Name: "block domain", Allow: false, Direction: "in", Profile: "domain", Protocol: "TCP", Ports: "0-65535", IPs: "0.0.0.0/0"},
+		{Name: "block high ports", Allow: false, Direction: "in", Profile: "any", Protocol: "UDP", Ports: "1024-65535", IPs: "::/0", LocalIPs: "fd00::1"},
+	}
+
+	var sb strings.Builder
+	if err := writePF(&sb, ruleIFs, wfw.ProfilePublic, "wfw", "test.json"); err != nil {
+		t.Fatal(err)
+	}
+	_, body, _ := strings.Cut(sb.String(), "anchor \"wfw\"\n")
+	gotwant.Test(t, body, `table <wfw_r0_remoteip4> const { 10.0.0.0/24, 10.0.1.0/31 }
+block in quick inet6 proto udp from any to fd00::1 port 1024:65535 label "block high ports"
+pass in quick inet proto tcp from <wfw_r0_remoteip4> to any port { 80, 443 } label "allow web"
+pass in quick inet6 proto tcp from fd00::/8 to any port { 80, 443 } label "allow web"
+pass out quick inet proto udp from any to 10.0.0.53 port 53 label "allow DNS"
+`)
+
+	t.Run("Generated", func(t *testing.T) {
+		var sb strings.Builder
+		if err := writePF(&sb, generatedRuleIFs(t), wfw.ProfilePrivate, "wfw", "test.json"); err != nil {
+			t.Fatal(err)
+		}
+		_, body, _ := strings.Cut(sb.String(), "anchor \"wfw\"\n")
+		gotwant.Test(t, body, `table <wfw_r1_remoteip4> const { 10.0.0.0/30, 10.0.0.4/32, 10.0.0.6/31, 10.0.0.8/29, 10.0.0.16/28, 10.0.0.32/27, 10.0.0.64/26, 10.0.0.128/25 }
+block in quick inet proto tcp from 10.0.0.5 to any port { 0:21, 23:65535 } label "block LAN(Except: allow admin)"
+block in quick inet proto tcp from <wfw_r1_remoteip4> to any label "block LAN(Except: allow admin)"
+block in quick inet proto tcp from 10.0.0.5 to any port 22 label "block LAN(Except: allow admin)"
+pass in quick inet proto tcp from 10.0.1.0/24 to any port 80 label "allow web"
+`)
+	})
+}
+
+func TestFirewalld(t *testing.T) {
+	ruleIFs := []RuleIF{
+		{Name: "allow web", Allow: true, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "80,8000-8080", IPs: "10.0.1.0-10.0.1.2,fd00::/8"},
+		{Name: "allow DNS", Allow: true, Direction: "out", Profile: "public", Protocol: "UDP", Ports: "0-65535", IPs: "10.0.0.53", RemotePorts: "53"},
+		{Name: "allow NTP replies", Allow: true, Direction: "in", Profile: "public", Protocol: "UDP", Ports: "0-65535", IPs: "10.0.0.123", RemotePorts: "123"},
+		{Name: "block ping", Allow: false, Direction: "in", Profile: "any", Protocol: "ICMPv4", IPs: "0.0.0.0/0", LocalIPs: "10.0.0.1"},
+	}
+
+	rs, err := hostRules(ruleIFs, wfw.ProfilePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, outbound, err := firewalldRules(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotwant.Test(t, outbound, 1)
+
+	t.Run("RichRules", func(t *testing.T) {
+		var sb strings.Builder
+		writeFirewallCmd(&sb, rules, "wfw", "test.json")
+		gotwant.Test(t, sb.String(), `# generated by wfw from test.json
+firewall-cmd --permanent --new-zone=wfw 2>/dev/null
+firewall-cmd --permanent --zone=wfw --list-rich-rules | while IFS= read -r r; do firewall-cmd --permanent --zone=wfw --remove-rich-rule="$r"; done
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" destination address="10.0.0.1" protocol value="icmp" drop' # block ping
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.1.0/31" port port="80" protocol="tcp" accept' # allow web
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.1.2" port port="80" protocol="tcp" accept' # allow web
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv6" source address="fd00::/8" port port="80" protocol="tcp" accept' # allow web
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.1.0/31" port port="8000-8080" protocol="tcp" accept' # allow web
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.1.2" port port="8000-8080" protocol="tcp" accept' # allow web
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv6" source address="fd00::/8" port port="8000-8080" protocol="tcp" accept' # allow web
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.0.123" source-port port="123" protocol="udp" accept' # allow NTP replies
+firewall-cmd --reload
+`)
+	})
+
+	t.Run("Zone", func(t *testing.T) {
+		var sb strings.Builder
+		if err := writeFirewalldZone(&sb, rules[:1], "wfw", "test.json"); err != nil {
+			t.Fatal(err)
+		}
+		_, body, _ := strings.Cut(sb.String(), "-->\n")
+		gotwant.Test(t, body, `<zone>
+  <short>wfw</short>
+  <description>generated by wfw from test.json</description>
+  <rule family="ipv4">
+    <!-- block ping -->
+    <destination address="10.0.0.1"></destination>
+    <protocol value="icmp"></protocol>
+    <drop></drop>
+  </rule>
+</zone>
+`)
+	})
+
+	t.Run("LocalAndRemotePorts", func(t *testing.T) {
+		rs, err := hostRules([]RuleIF{
+			{Name: "both", Allow: true, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "80", IPs: "10.0.0.1", RemotePorts: "1024-65535"},
+		}, wfw.ProfilePublic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = firewalldRules(rs)
+		gotwant.TestError(t, err, "local and remote ports")
+	})
+
+	t.Run("Generated", func(t *testing.T) {
+		rs, err := hostRules(generatedRuleIFs(t), wfw.ProfilePrivate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules, _, err := firewalldRules(rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sb strings.Builder
+		writeFirewallCmd(&sb, rules, "wfw", "test.json")
+		_, body, _ := strings.Cut(sb.String(), "done\n")
+		gotwant.Test(t, body, `firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.0.5" port port="0-21" protocol="tcp" drop' # block LAN(Except: allow admin)
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.0.5" port port="23-65535" protocol="tcp" drop' # block LAN(Except: allow admin)
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.0.0/30" protocol value="tcp" drop' # block LAN(Except: allow admin)
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.0.4" protocol value="tcp" drop' # block LAN(Except: allow admin)
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.0.6/31" protocol value="tcp" drop' # block LAN(Except: allow admin)
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.0.8/29" protocol value="tcp" drop' # block LAN(Except: allow admin)
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.0.16/28" protocol value="tcp" drop' # block LAN(Except: allow admin)
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.0.32/27" protocol value="tcp" drop' # block LAN(Except: allow admin)
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.0.64/26" protocol value="tcp" drop' # block LAN(Except: allow admin)
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.0.128/25" protocol value="tcp" drop' # block LAN(Except: allow admin)
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.0.5" port port="22" protocol="tcp" drop' # block LAN(Except: allow admin)
+firewall-cmd --permanent --zone=wfw --add-rich-rule='rule family="ipv4" source address="10.0.1.0/24" port port="80" protocol="tcp" accept' # allow web
+firewall-cmd --reload
+`)
+	})
+}
+
+func TestSecurityGroup(t *testing.T) {
+	ruleIFs := []RuleIF{
+		{Name: "allow web", Allow: true, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "80,443", IPs: "10.0.1.0-10.0.1.2,fd00::/8"},
+		{Name: "allow DNS", Allow: true, Direction: "out", Profile: "public", Protocol: "UDP", Ports: "0-65535", IPs: "10.0.0.53", RemotePorts: "53"},
+		{Name: "allow ping \"v4\"", Allow: true, Direction: "in", Profile: "any", Protocol: "ICMPv4", IPs: "10.0.0.0/8"},
+		{Name: "block domain", Allow: false, Direction: "in", Profile: "domain", Protocol: "TCP", Ports: "0-65535", IPs: "0.0.0.0/0"},
+	}
+
+	rs, err := hostRules(ruleIFs, wfw.ProfilePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, notes, err := sgRules(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotwant.Test(t, len(notes), 0)
+
+	t.Run("AWS", func(t *testing.T) {
+		var sb strings.Builder
+		if err := writeAWSSG(&sb, rules[2:]); err != nil {
+			t.Fatal(err)
+		}
+		gotwant.Test(t, sb.String(), `{
+  "IpPermissions": [
+    {
+      "IpProtocol": "icmp",
+      "FromPort": -1,
+      "ToPort": -1,
+      "IpRanges": [
+        {
+          "CidrIp": "10.0.0.0/8",
+          "Description": "allow ping  v4 "
+        }
+      ]
+    }
+  ],
+  "IpPermissionsEgress": [
+    {
+      "IpProtocol": "udp",
+      "FromPort": 53,
+      "ToPort": 53,
+      "IpRanges": [
+        {
+          "CidrIp": "10.0.0.53/32",
+          "Description": "allow DNS"
+        }
+      ]
+    }
+  ]
+}
+`)
+	})
+
+	t.Run("Terraform", func(t *testing.T) {
+		var sb strings.Builder
+		writeTerraform(&sb, rules[:2], "wfw", "test.json")
+		gotwant.Test(t, sb.String(), `# generated by wfw from test.json
+# packets no rule matches are denied by the security group
+
+variable "wfw_security_group_id" {
+  type = string
+}
+
+resource "aws_security_group_rule" "wfw_in_0" {
+  security_group_id = var.wfw_security_group_id
+  type              = "ingress"
+  protocol          = "tcp"
+  from_port         = 80
+  to_port           = 80
+  cidr_blocks       = ["10.0.1.0/31", "10.0.1.2/32"]
+  ipv6_cidr_blocks  = ["fd00::/8"]
+  description       = "allow web"
+}
+
+resource "aws_security_group_rule" "wfw_in_1" {
+  security_group_id = var.wfw_security_group_id
+  type              = "ingress"
+  protocol          = "tcp"
+  from_port         = 443
+  to_port           = 443
+  cidr_blocks       = ["10.0.1.0/31", "10.0.1.2/32"]
+  ipv6_cidr_blocks  = ["fd00::/8"]
+  description       = "allow web"
+}
+`)
+	})
+
+	t.Run("Widened", func(t *testing.T) {
+		rs, err := hostRules([]RuleIF{
+			{Name: "allow RDP", Allow: true, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "3389", IPs: "10.0.0.0/8", LocalIPs: "10.1.0.5"},
+		}, wfw.ProfilePublic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules, notes, err := sgRules(rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotwant.Test(t, len(rules), 1)
+		gotwant.Test(t, notes, []string{`rule "allow RDP": local IPs are ignored, as security groups cannot match them`})
+	})
+
+	t.Run("Inexpressible", func(t *testing.T) {
+		for _, ruleIFs := range [][]RuleIF{
+			{
+				{Name: "allow RDP", Allow: true, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "3389", IPs: "10.0.0.0/8", LocalIPs: "10.1.0.5"},
+				{Name: "block TCP", Allow: false, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "0-65535", IPs: "10.0.0.0/8"},
+			},
+			{
+				{Name: "block SMB", Allow: false, Direction: "in", Profile: "any", Protocol: "TCP", Ports: "445", IPs: "10.0.0.0/8"},
+				{Name: "allow LAN", Allow: true, Direction: "in", Profile: "any", Protocol: "any", IPs: "10.0.0.0/8"},
+			},
+		} {
+			c := globalCmd{Aggregation: "ip", IPStyle: "range", Except: "(Except: %)"}
+			out, _, err := c.generate(ruleIFs, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs, err := hostRules(out, wfw.ProfilePublic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = sgRules(rs)
+			gotwant.TestError(t, err, "cannot be expressed")
+		}
+	})
+
+	t.Run("Generated", func(t *testing.T) {
+		rs, err := hostRules(generatedRuleIFs(t), wfw.ProfilePrivate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules, notes, err := sgRules(rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotwant.Test(t, len(notes), 0)
+		var sb strings.Builder
+		if err := writeAWSSG(&sb, rules); err != nil {
+			t.Fatal(err)
+		}
+		gotwant.Test(t, sb.String(), `{
+  "IpPermissions": [
+    {
+      "IpProtocol": "tcp",
+      "FromPort": 80,
+      "ToPort": 80,
+      "IpRanges": [
+        {
+          "CidrIp": "10.0.1.0/24",
+          "Description": "allow web"
+        }
+      ]
+    }
+  ],
+  "IpPermissionsEgress": []
+}
+`)
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/shu-go/wfw/wfw"
+)
+
+// writeNft writes ruleIFs applying in profile as an nft -f script,
+// which replaces the table inet <chain> with the chains <chain>-in and <chain>-out.
+//
+// The lists of ports and IPs of a rule become named interval sets,
+// those of IPs one per family and those of ports one for both families.
+// The rules are in the order of hostRules.
+func writeNft(w io.Writer, ruleIFs []RuleIF, profile wfw.Profile, chain, source string) error {
+	var sets []string
+	defined := make(map[string]bool)
+	rules := map[string][]string{"in": nil, "out": nil}
+
+	for _, i := range blocksFirst(ruleIFs) {
+		rif := ruleIFs[i]
+		p, err := parseProfile(rif.Profile)
+		if err != nil {
+			return fmt.Errorf("rule %q: %v", rif.Name, err)
+		}
+		if !p.Contains(profile) {
+			continue
+		}
+
+		for _, family := range []int{4, 6} {
+			remoteIPs, err := addrElems(rif.IPs, family, false)
+			if err != nil {
+				return fmt.Errorf("rule %q: %v", rif.Name, err)
+			}
+			localIPs, err := addrElems(rif.LocalIPs, family, true)
+			if err != nil {
+				return fmt.Errorf("rule %q: %v", rif.Name, err)
+			}
+			if remoteIPs == nil || localIPs == nil {
+				// nothing of the family
+				continue
+			}
+
+			dir := rif.Direction
+			if dir == "" {
+				dir = "in"
+			}
+
+			// remote and local in terms of nft
+			remote, local := "s", "d"
+			if dir == "out" {
+				remote, local = "d", "s"
+			}
+
+			ip, addrType := "ip", "ipv4_addr"
+			if family == 6 {
+				ip, addrType = "ip6", "ipv6_addr"
+			}
+
+			var exprs []string
+			match := func(key, setName, typ string, elems []string) {
+				if len(elems) == 0 || len(elems) == 1 && elems[0] == "" {
+					return
+				}
+				if len(elems) == 1 {
+					exprs = append(exprs, key+" "+elems[0])
+					return
+				}
+
+				if !defined[setName] {
+					defined[setName] = true
+					sets = append(sets, fmt.Sprintf("\tset %s {\n\t\ttype %s\n\t\tflags interval\n\t\tauto-merge\n\t\telements = { %s }\n\t}\n", setName, typ, strings.Join(elems, ", ")))
+				}
+				exprs = append(exprs, key+" @"+setName)
+			}
+
+			if remoteIPs[0] == "" && localIPs[0] == "" {
+				// the table is of both families
+				exprs = append(exprs, "meta nfproto ipv"+strconv.Itoa(family))
+			}
+
+			protocol := strings.ToLower(rif.Protocol)
+			switch protocol {
+			case "any":
+			case "icmpv4":
+				exprs = append(exprs, "meta l4proto icmp")
+			case "icmpv6":
+				exprs = append(exprs, "meta l4proto ipv6-icmp")
+			default:
+				exprs = append(exprs, "meta l4proto "+protocol)
+			}
+
+			match(ip+" "+remote+"addr", fmt.Sprintf("r%d_remoteip%d", i, family), addrType, remoteIPs)
+			match(ip+" "+local+"addr", fmt.Sprintf("r%d_localip%d", i, family), addrType, localIPs)
+			if protocol == "tcp" || protocol == "udp" {
+				match(protocol+" "+local+"port", fmt.Sprintf("r%d_port", i), "inet_service", portElems(rif.Ports))
+				match(protocol+" "+remote+"port", fmt.Sprintf("r%d_remoteport", i), "inet_service", portElems(rif.RemotePorts))
+			}
+
+			verdict := "drop"
+			if rif.Allow {
+				verdict = "accept"
+			}
+			// a comment is up to 128 bytes, with the terminating null
+			exprs = append(exprs, verdict, "comment "+commentQuote(rif.Name, 127))
+
+			rules[dir] = append(rules[dir], "\t\t"+strings.Join(exprs, " ")+"\n")
+		}
+	}
+
+	fmt.Fprintf(w, "#!/usr/sbin/nft -f\n")
+	fmt.Fprintf(w, "# generated by wfw from %s\n", source)
+	fmt.Fprintf(w, "# packets no rule matches are accepted by this table\n")
+	fmt.Fprintf(w, "table inet %s\n", chain)
+	fmt.Fprintf(w, "delete table inet %s\n", chain)
+	fmt.Fprintf(w, "table inet %s {\n", chain)
+	for _, s := range sets {
+		fmt.Fprint(w, s)
+	}
+	for _, dir := range []string{"in", "out"} {
+		hook := "input"
+		if dir == "out" {
+			hook = "output"
+		}
+		fmt.Fprintf(w, "\tchain %s-%s {\n", chain, dir)
+		fmt.Fprintf(w, "\t\ttype filter hook %s priority 0; policy accept;\n", hook)
+		for _, r := range rules[dir] {
+			fmt.Fprint(w, r)
+		}
+		fmt.Fprintf(w, "\t}\n")
+	}
+	fmt.Fprintf(w, "}\n")
+
+	return nil
+}
+
+// addrElems returns the elements of the family in a list of IPs of RuleIF.
+// It returns nil if there is no element of the family,
+// and [""] for any address of the family, which an empty list means if orAny.
+func addrElems(ips string, family int, orAny bool) ([]string, error) {
+	iprs, err := parseIPRanges(ips, orAny)
+	if err != nil {
+		return nil, err
+	}
+
+	var elems []string
+	for i, ip := range strings.Split(ips, ",") {
+		r := iprs[i]
+		if r.Start == nil {
+			return []string{""}, nil
+		}
+		if wfw.Family(r.Start) != family {
+			continue
+		}
+		if r.Equal(wfw.AnyIP(family)) {
+			return []string{""}, nil
+		}
+		elems = append(elems, strings.TrimSpace(ip))
+	}
+	return elems, nil
+}
+
+// portElems returns the elements in a list of ports of RuleIF, or [""] for any port.
+func portElems(ports string) []string {
+	var elems []string
+	for _, r := range parsePortRanges(ports, true) {
+		if r.Start == nil || r.Equal(wfw.AnyPort) {
+			return []string{""}
+		}
+		elems = append(elems, stringifyPortRange(r))
+	}
+	return elems
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/shu-go/wfw/wfw"
+)
+
+// writePF writes ruleIFs applying in profile as a pf.conf fragment,
+// to be loaded into the anchor <chain>.
+//
+// Lists of IPs become tables, as CIDR prefixes.
+// The rules are in the order of hostRules, and each of them is quick,
+// so that the first matching one decides, and rules after the anchor do not override them.
+func writePF(w io.Writer, ruleIFs []RuleIF, profile wfw.Profile, chain, source string) error {
+	var tables, rules []string
+
+	for _, i := range blocksFirst(ruleIFs) {
+		rif := ruleIFs[i]
+		p, err := parseProfile(rif.Profile)
+		if err != nil {
+			return fmt.Errorf("rule %q: %v", rif.Name, err)
+		}
+		if !p.Contains(profile) {
+			continue
+		}
+
+		for _, family := range []int{4, 6} {
+			remoteIPs, err := addrElems(rif.IPs, family, false)
+			if err != nil {
+				return fmt.Errorf("rule %q: %v", rif.Name, err)
+			}
+			localIPs, err := addrElems(rif.LocalIPs, family, true)
+			if err != nil {
+				return fmt.Errorf("rule %q: %v", rif.Name, err)
+			}
+			if remoteIPs == nil || localIPs == nil {
+				// nothing of the family
+				continue
+			}
+
+			addr := func(name string, elems []string) string {
+				if elems[0] == "" {
+					return "any"
+				}
+
+				var cidrs []string
+				for _, e := range elems {
+					r, _ := parseIPRange(e)
+					cidrs = append(cidrs, cidrsFromRange(r)...)
+				}
+				if len(cidrs) == 1 {
+					return trimHostPrefix(cidrs[0])
+				}
+
+				table := fmt.Sprintf("%s_r%d_%s%d", chain, i, name, family)
+				tables = append(tables, fmt.Sprintf("table <%s> const { %s }", table, strings.Join(cidrs, ", ")))
+				return "<" + table + ">"
+			}
+			remote := addr("remoteip", remoteIPs)
+			local := addr("localip", localIPs)
+
+			args := []string{"block", rif.Direction, "quick"}
+			if rif.Allow {
+				args[0] = "pass"
+			}
+			if rif.Direction == "" {
+				args[1] = "in"
+			}
+
+			if family == 6 {
+				args = append(args, "inet6")
+			} else {
+				args = append(args, "inet")
+			}
+
+			protocol := strings.ToLower(rif.Protocol)
+			switch protocol {
+			case "any":
+				protocol = ""
+			case "icmpv4":
+				protocol = "icmp"
+			case "icmpv6":
+				protocol = "icmp6"
+			}
+			if protocol != "" {
+				args = append(args, "proto", protocol)
+			}
+
+			var remotePort, localPort string
+			if protocol == "tcp" || protocol == "udp" {
+				remotePort = pfPorts(portElems(rif.RemotePorts))
+				localPort = pfPorts(portElems(rif.Ports))
+			}
+
+			if args[1] == "in" {
+				args = append(args, "from", remote+remotePort, "to", local+localPort)
+			} else {
+				args = append(args, "from", local+localPort, "to", remote+remotePort)
+			}
+
+			// a label is up to 64 bytes, with the terminating null
+			args = append(args, "label", commentQuote(rif.Name, 63))
+
+			rules = append(rules, strings.Join(args, " "))
+		}
+	}
+
+	fmt.Fprintf(w, "# generated by wfw from %s\n", source)
+	fmt.Fprintf(w, "# apply: pfctl -a %s -f this file\n", chain)
+	fmt.Fprintf(w, "# pf.conf needs: anchor \"%s\"\n", chain)
+	for _, t := range tables {
+		fmt.Fprintln(w, t)
+	}
+	for _, r := range rules {
+		fmt.Fprintln(w, r)
+	}
+
+	return nil
+}
+
+// pfPorts returns the port part of an address of pf, such as " port { 80, 443 }",
+// or "" for any port.
+func pfPorts(elems []string) string {
+	if elems[0] == "" {
+		return ""
+	}
+
+	ports := make([]string, 0, len(elems))
+	for _, e := range elems {
+		ports = append(ports, strings.Replace(e, "-", ":", 1))
+	}
+	if len(ports) == 1 {
+		return " port " + ports[0]
+	}
+	return " port { " + strings.Join(ports, ", ") + " }"
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/shu-go/rng"
+	"github.com/shu-go/wfw/wfw"
+)
+
+// sgRule is an allow rule of a security group of AWS.
+type sgRule struct {
+	Type     string // "ingress" or "egress"
+	Protocol string // "tcp", "udp", "icmp", "icmpv6", "-1" or a number
+
+	// the port of the instance for ingress, of the peer for egress
+	FromPort, ToPort int
+
+	CIDRs, IPv6CIDRs []string
+
+	Description string
+}
+
+// hasPorts reports whether FromPort and ToPort mean something to the protocol.
+func (r sgRule) hasPorts() bool {
+	switch r.Protocol {
+	case "tcp", "udp", "icmp", "icmpv6":
+		return true
+	}
+	return false
+}
+
+// sgRules returns the allow rules of rs as rules of a security group,
+// which allows what they match and denies the others.
+//
+// Security groups cannot match local IPs, and match only the port of the instance for ingress
+// and that of the peer for egress, so the allow rules are widened over them.
+// It is an error if the widened rule, or a rule of any protocol, matches packets of a block rule.
+// It also returns notes on the widened rules.
+func sgRules(rs wfw.RuleSet) ([]sgRule, []string, error) {
+	var rules []sgRule
+	var notes []string
+	type key struct {
+		typ, protocol    string
+		fromPort, toPort int
+		description      string
+	}
+	index := make(map[key]int)
+
+	for _, r := range rs {
+		if !r.Allow {
+			continue
+		}
+
+		protocol := strings.ToLower(r.Protocol)
+		family := wfw.Family(r.IP.Start)
+
+		// widen r over what security groups cannot match
+		var widened []string
+		if r.LocalIP.Start != nil && !r.LocalIP.Equal(wfw.AnyIP(family)) {
+			r.LocalIP = rng.Range{}
+			widened = append(widened, "local IPs")
+		}
+		if protocol == "tcp" || protocol == "udp" {
+			if r.Direction == "out" {
+				if !r.Port.Equal(wfw.AnyPort) {
+					r.Port = wfw.AnyPort
+					widened = append(widened, "local ports of egress")
+				}
+			} else if r.RemotePort.Start != nil && !r.RemotePort.Equal(wfw.AnyPort) {
+				r.RemotePort = rng.Range{}
+				widened = append(widened, "remote ports of ingress")
+			}
+		}
+
+		for _, b := range rs {
+			if b.Allow {
+				continue
+			}
+			// a rule of any protocol matches every port of the protocol of the other
+			a := r
+			if strings.EqualFold(a.Protocol, "any") {
+				a.Protocol, a.Port, a.RemotePort = b.Protocol, wfw.AnyPort, rng.Range{}
+			}
+			if strings.EqualFold(b.Protocol, "any") {
+				b.Protocol, b.Port, b.RemotePort = a.Protocol, wfw.AnyPort, rng.Range{}
+			}
+			if !a.Intersects(b) {
+				continue
+			}
+
+			reason := "an allow rule of any protocol allows every protocol"
+			if len(widened) > 0 {
+				reason = "security groups cannot match " + strings.Join(widened, " and ")
+			}
+			return nil, nil, fmt.Errorf("rule %q: the block of rule %q cannot be expressed, as %s", r.Name, b.Name, reason)
+		}
+		if len(widened) > 0 {
+			notes = append(notes, fmt.Sprintf("rule %q: %s are ignored, as security groups cannot match them", r.Name, strings.Join(widened, " and ")))
+		}
+
+		sr := sgRule{
+			Type:        "ingress",
+			Protocol:    protocol,
+			Description: awsDescription(r.Name),
+		}
+		if r.Direction == "out" {
+			sr.Type = "egress"
+		}
+
+		switch protocol {
+		case "any":
+			sr.Protocol = "-1"
+		case "icmpv4":
+			sr.Protocol = "icmp"
+			sr.FromPort, sr.ToPort = -1, -1
+		case "icmpv6":
+			sr.FromPort, sr.ToPort = -1, -1
+		case "tcp", "udp":
+			ports := r.Port
+			if r.Direction == "out" {
+				ports = r.RemotePort
+			}
+			if ports.Start == nil {
+				ports = wfw.AnyPort
+			}
+			sr.FromPort, sr.ToPort = int(ports.Start.(rng.Int)), int(ports.End.(rng.Int))
+		}
+
+		// rules differing only in CIDRs are merged
+		k := key{sr.Type, sr.Protocol, sr.FromPort, sr.ToPort, sr.Description}
+		i, found := index[k]
+		if !found {
+			i = len(rules)
+			index[k] = i
+			rules = append(rules, sr)
+		}
+		if family == 6 {
+			rules[i].IPv6CIDRs = append(rules[i].IPv6CIDRs, cidrsFromRange(r.IP)...)
+		} else {
+			rules[i].CIDRs = append(rules[i].CIDRs, cidrsFromRange(r.IP)...)
+		}
+	}
+
+	return rules, notes, nil
+}
+
+// awsDescription returns s as a description of AWS,
+// replacing characters out of a-zA-Z0-9. _-:/()#,@[]+=&;{}!$* with spaces.
+func awsDescription(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		case strings.ContainsRune(". _-:/()#,@[]+=&;{}!$*", r):
+			return r
+		}
+		return ' '
+	}, s)
+
+	// a description is up to 255 characters
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	return s
+}
+
+type awsIPPermission struct {
+	IpProtocol string
+	FromPort   *int           `json:",omitempty"`
+	ToPort     *int           `json:",omitempty"`
+	IpRanges   []awsIPRange   `json:",omitempty"`
+	Ipv6Ranges []awsIPv6Range `json:",omitempty"`
+}
+
+type awsIPRange struct {
+	CidrIp      string
+	Description string
+}
+
+type awsIPv6Range struct {
+	CidrIpv6    string
+	Description string
+}
+
+// writeAWSSG writes rules as the IpPermissions and IpPermissionsEgress of a security group,
+// as aws ec2 describe-security-groups does.
+// Each of them can be passed to --ip-permissions of aws ec2 authorize-security-group-ingress and -egress.
+func writeAWSSG(w io.Writer, rules []sgRule) error {
+	sg := struct {
+		IpPermissions       []awsIPPermission
+		IpPermissionsEgress []awsIPPermission
+	}{
+		IpPermissions:       []awsIPPermission{},
+		IpPermissionsEgress: []awsIPPermission{},
+	}
+
+	for _, r := range rules {
+		p := awsIPPermission{IpProtocol: r.Protocol}
+		if r.hasPorts() {
+			from, to := r.FromPort, r.ToPort
+			p.FromPort, p.ToPort = &from, &to
+		}
+		for _, c := range r.CIDRs {
+			p.IpRanges = append(p.IpRanges, awsIPRange{CidrIp: c, Description: r.Description})
+		}
+		for _, c := range r.IPv6CIDRs {
+			p.Ipv6Ranges = append(p.Ipv6Ranges, awsIPv6Range{CidrIpv6: c, Description: r.Description})
+		}
+
+		if r.Type == "egress" {
+			sg.IpPermissionsEgress = append(sg.IpPermissionsEgress, p)
+		} else {
+			sg.IpPermissions = append(sg.IpPermissions, p)
+		}
+	}
+
+	content, err := json.MarshalIndent(sg, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(content))
+
+	return nil
+}
+
+// writeTerraform writes rules as aws_security_group_rule resources named <prefix>_in_<n> and <prefix>_out_<n>,
+// of the security group given by the variable <prefix>_security_group_id.
+func writeTerraform(w io.Writer, rules []sgRule, prefix, source string) {
+	quote := func(s string) string {
+		// s has no quotes nor backslashes, and escapes interpolations
+		return "\"" + strings.ReplaceAll(s, "${", "$${") + "\""
+	}
+	list := func(ss []string) string {
+		quoted := make([]string, 0, len(ss))
+		for _, s := range ss {
+			quoted = append(quoted, quote(s))
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+
+	fmt.Fprintf(w, "# generated by wfw from %s\n", source)
+	fmt.Fprintf(w, "# packets no rule matches are denied by the security group\n")
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "variable \"%s_security_group_id\" {\n", prefix)
+	fmt.Fprintf(w, "  type = string\n")
+	fmt.Fprintf(w, "}\n")
+
+	n := map[string]int{}
+	for _, r := range rules {
+		dir := "in"
+		if r.Type == "egress" {
+			dir = "out"
+		}
+
+		from, to := r.FromPort, r.ToPort
+		if !r.hasPorts() {
+			from, to = 0, 0
+		}
+
+		fmt.Fprintf(w, "\n")
+		fmt.Fprintf(w, "resource \"aws_security_group_rule\" \"%s_%s_%d\" {\n", prefix, dir, n[dir])
+		fmt.Fprintf(w, "  %-17s = var.%s_security_group_id\n", "security_group_id", prefix)
+		fmt.Fprintf(w, "  %-17s = %s\n", "type", quote(r.Type))
+		fmt.Fprintf(w, "  %-17s = %s\n", "protocol", quote(r.Protocol))
+		fmt.Fprintf(w, "  %-17s = %d\n", "from_port", from)
+		fmt.Fprintf(w, "  %-17s = %d\n", "to_port", to)
+		if len(r.CIDRs) > 0 {
+			fmt.Fprintf(w, "  %-17s = %s\n", "cidr_blocks", list(r.CIDRs))
+		}
+		if len(r.IPv6CIDRs) > 0 {
+			fmt.Fprintf(w, "  %-17s = %s\n", "ipv6_cidr_blocks", list(r.IPv6CIDRs))
+		}
+		fmt.Fprintf(w, "  %-17s = %s\n", "description", quote(r.Description))
+		fmt.Fprintf(w, "}\n")
+
+		n[dir]++
+	}
+}
@@ -0,0 +1,114 @@
+package wfw
+
+import (
+	"github.com/shu-go/rng"
+)
+
+// Box is a region of an N-dimensional match space, a range for each Dimension.
+type Box []rng.Range
+
+func (b Box) Equal(a Box) bool {
+	if len(b) != len(a) {
+		return false
+	}
+	for d := range b {
+		if !b[d].Equal(a[d]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b Box) Contains(a Box) bool {
+	for d := range b {
+		if !b[d].ContainsRange(a[d]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersection returns the common region of b and a, if any.
+func (b Box) Intersection(a Box) (Box, bool) {
+	c := make(Box, len(b))
+	for d := range b {
+		if !b[d].IsIntersecting(a[d]) {
+			return nil, false
+		}
+		c[d] = rng.NewRange(rng.Max(b[d].Start, a[d].Start), rng.Min(b[d].End, a[d].End))
+	}
+	return c, true
+}
+
+func (b Box) intersects(a Box) bool {
+	for d := range b {
+		if !b[d].IsIntersecting(a[d]) {
+			return false
+		}
+	}
+	return true
+}
+
+// touches reports whether b and a intersect or are adjacent in a dimension,
+// intersecting in the others.
+func (b Box) touches(a Box) bool {
+	adjacent := 0
+	for d := range b {
+		if b[d].IsIntersecting(a[d]) {
+			continue
+		}
+		if !b[d].End.Next().Equal(a[d].Start) && !a[d].End.Next().Equal(b[d].Start) {
+			return false
+		}
+		adjacent++
+	}
+	return adjacent <= 1
+}
+
+// Minus returns the pieces of b outside a, as slabs:
+// for each dimension in order, the parts of b below and above a in the dimension,
+// within a in the preceding dimensions.
+// So b is cut only around a, into at most two pieces for each dimension.
+func (b Box) Minus(a Box) []Box {
+	if a.Contains(b) {
+		return nil
+	}
+	if !b.intersects(a) {
+		return []Box{b}
+	}
+
+	var bb []Box
+	rest := b
+	for d := range b {
+		if rest[d].Start.Less(a[d].Start) {
+			bb = append(bb, rest.with(d, rng.NewRange(rest[d].Start, a[d].Start.Prev())))
+		}
+		if a[d].End.Less(rest[d].End) {
+			bb = append(bb, rest.with(d, rng.NewRange(a[d].End.Next(), rest[d].End)))
+		}
+		rest = rest.with(d, rng.NewRange(rng.Max(rest[d].Start, a[d].Start), rng.Min(rest[d].End, a[d].End)))
+	}
+
+	return bb
+}
+
+// with returns a copy of b whose dimension d is replaced with r.
+func (b Box) with(d int, r rng.Range) Box {
+	c := make(Box, len(b))
+	copy(c, b)
+	c[d] = r
+	return c
+}
+
+// joinable reports whether b and a are adjacent in the dimension d (b first) and equal in the others.
+func (b Box) joinable(a Box, d int) bool {
+	for dd := range b {
+		if dd == d {
+			continue
+		}
+		if !b[dd].Equal(a[dd]) {
+			return false
+		}
+	}
+	return b[d].End.Less(a[d].Start) && b[d].End.Next().Equal(a[d].Start)
+}
@@ -0,0 +1,111 @@
+package wfw
+
+import (
+	"sort"
+)
+
+// Change is a region of packets on which two rule sets decide differently.
+type Change struct {
+	// Region is a rule matching the packets.
+	Region Rule
+
+	From, To Decision
+}
+
+// Diff returns the regions whose decisions change from before to after,
+// both of which are interpreted by their first matching rules.
+// The regions are joined by Resolve with dims,
+// and sorted by direction, protocol, address family, and then by To and From.
+func Diff(before, after RuleSet, dims []Dimension) []Change {
+	protocols := protocolsOf(before, after)
+	oldwk := regions(pieces(before, dims, protocols))
+	newwk := regions(pieces(after, dims, protocols))
+
+	all := append(append([]piece{}, oldwk...), newwk...)
+	n := len(oldwk)
+	oldOverlapping := make([][]int, len(oldwk))
+	newOverlapping := make([][]int, len(newwk))
+
+	changed := make(map[[2]Decision]RuleSet)
+	add := func(r Rule, b Box, from, to Decision) {
+		region := Rule{
+			Direction: r.Direction,
+			Protocol:  r.Protocol,
+			Allow:     true,
+			IP:        r.IP,
+		}
+		region.setBox(dims, b)
+		changed[[2]Decision{from, to}] = append(changed[[2]Decision{from, to}], region)
+	}
+
+	for _, p := range intersectingPairs(all, func(i, k int) bool { return (i < n) != (k < n) }) {
+		o, e := min(p[0], p[1]), max(p[0], p[1])-n
+		oldOverlapping[o] = append(oldOverlapping[o], e)
+		newOverlapping[e] = append(newOverlapping[e], o)
+
+		if oldwk[o].r.Allow != newwk[e].r.Allow {
+			b, _ := oldwk[o].b.Intersection(newwk[e].b)
+			add(oldwk[o].r, b, DecisionOf(oldwk[o].r), DecisionOf(newwk[e].r))
+		}
+	}
+
+	// no longer matching
+	for o, e := range oldwk {
+		sort.Ints(oldOverlapping[o])
+		for _, b := range minusAll([]Box{e.b}, newwk, oldOverlapping[o]) {
+			add(e.r, b, DecisionOf(e.r), NoMatch)
+		}
+	}
+
+	// newly matching
+	for o, e := range newwk {
+		sort.Ints(newOverlapping[o])
+		for _, b := range minusAll([]Box{e.b}, oldwk, newOverlapping[o]) {
+			add(e.r, b, NoMatch, DecisionOf(e.r))
+		}
+	}
+
+	var changes []Change
+	for ft, rs := range changed {
+		for _, r := range rs.Resolve(dims) {
+			changes = append(changes, Change{Region: r, From: ft[0], To: ft[1]})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+
+		if c := compareSpace(a.Region, b.Region); c != 0 {
+			return c < 0
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+
+		ba, bb := a.Region.box(dims), b.Region.box(dims)
+		for d := range ba {
+			if c := compareRange(ba[d], bb[d]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	return changes
+}
+
+// regions returns the regions where each of wk matches first, as pieces of the rules.
+func regions(wk []piece) []piece {
+	firsts, _ := firstRegions(wk)
+
+	var result []piece
+	for k, bb := range firsts {
+		for _, b := range bb {
+			result = append(result, piece{r: wk[k].r, b: b})
+		}
+	}
+	return result
+}
@@ -0,0 +1,135 @@
+package wfw
+
+import (
+	"github.com/shu-go/rng"
+)
+
+// Dimension is an axis of the match space of rules,
+// along which RuleSet.Resolve splits and joins rules.
+//
+// To add a match field to Rule, implement a Dimension for it
+// and add it to the dimensions passed to Resolve.
+type Dimension interface {
+	Name() string
+
+	// Ranges returns the values of r in this dimension.
+	// Most dimensions return exactly one range.
+	Ranges(r Rule) []rng.Range
+
+	// SetRange sets v as the value of r in this dimension.
+	SetRange(r *Rule, v rng.Range)
+}
+
+var (
+	LocalPortDimension  Dimension = localPortDim{}
+	RemoteIPDimension   Dimension = remoteIPDim{}
+	RemotePortDimension Dimension = remotePortDim{}
+	LocalIPDimension    Dimension = localIPDim{}
+	ProfileDimension    Dimension = profileDim{}
+)
+
+// Dimensions returns the dimensions used by Hoge, ordered by the priority of joining.
+func Dimensions(portfirst bool) []Dimension {
+	if portfirst {
+		return []Dimension{LocalPortDimension, RemoteIPDimension, RemotePortDimension, LocalIPDimension, ProfileDimension}
+	}
+	return []Dimension{RemoteIPDimension, LocalPortDimension, RemotePortDimension, LocalIPDimension, ProfileDimension}
+}
+
+type localPortDim struct{}
+
+func (localPortDim) Name() string { return "port" }
+
+func (localPortDim) Ranges(r Rule) []rng.Range {
+	if !hasPorts(r.Protocol) {
+		return []rng.Range{AnyPort}
+	}
+	return []rng.Range{r.Port}
+}
+
+func (localPortDim) SetRange(r *Rule, v rng.Range) {
+	if !hasPorts(r.Protocol) {
+		// keep the value, which means nothing
+		return
+	}
+	r.Port = v
+}
+
+type remoteIPDim struct{}
+
+func (remoteIPDim) Name() string                  { return "ip" }
+func (remoteIPDim) Ranges(r Rule) []rng.Range     { return []rng.Range{r.IP} }
+func (remoteIPDim) SetRange(r *Rule, v rng.Range) { r.IP = v }
+
+type remotePortDim struct{}
+
+func (remotePortDim) Name() string { return "remoteport" }
+
+func (remotePortDim) Ranges(r Rule) []rng.Range {
+	if !hasPorts(r.Protocol) {
+		return []rng.Range{AnyPort}
+	}
+	return []rng.Range{r.remotePort()}
+}
+
+func (remotePortDim) SetRange(r *Rule, v rng.Range) {
+	if !hasPorts(r.Protocol) {
+		return
+	}
+	if v.Equal(AnyPort) {
+		v = rng.Range{}
+	}
+	r.RemotePort = v
+}
+
+type localIPDim struct{}
+
+func (localIPDim) Name() string              { return "localip" }
+func (localIPDim) Ranges(r Rule) []rng.Range { return []rng.Range{r.localIP()} }
+
+func (localIPDim) SetRange(r *Rule, v rng.Range) {
+	if v.Equal(AnyIP(Family(r.IP.Start))) {
+		v = rng.Range{}
+	}
+	r.LocalIP = v
+}
+
+// profileDim maps profiles to rng.Int, domain=0, private=1, public=2.
+type profileDim struct{}
+
+func (profileDim) Name() string { return "profile" }
+
+func (profileDim) Ranges(r Rule) []rng.Range {
+	// a run of consecutive profiles is a range
+	var rr []rng.Range
+	p := r.Profile.Set()
+	for i := 0; i < len(profileNames); i++ {
+		if p&profileNames[i].p == 0 {
+			continue
+		}
+
+		j := i
+		for j+1 < len(profileNames) && p&profileNames[j+1].p != 0 {
+			j++
+		}
+		rr = append(rr, rng.NewRange(rng.Int(i), rng.Int(j)))
+		i = j
+	}
+	return rr
+}
+
+func (profileDim) SetRange(r *Rule, v rng.Range) {
+	var p Profile
+	for i := v.Start.(rng.Int); i <= v.End.(rng.Int); i++ {
+		p |= profileNames[i].p
+	}
+	if p == ProfileAny && r.Profile == 0 {
+		// keep the zero value
+		return
+	}
+	r.Profile = p
+}
+
+func (profileDim) Unite(r *Rule, a Rule) {
+	r.Profile = r.Profile.Set() | a.Profile.Set()
+}
@@ -0,0 +1,59 @@
+package wfw
+
+import (
+	"sort"
+)
+
+// Gaps returns the parts of universe matched by no rule of rs, joined by Resolve with dims.
+// The results take the other attributes, such as Allow and Tag, from the rules of universe.
+//
+// Rules of universe must not overlap each other, but for protocol any,
+// which stands for the protocols of no other rule of universe;
+// typically each of them matches all packets of a direction, a protocol and an address family.
+func Gaps(rs, universe RuleSet, dims []Dimension) RuleSet {
+	protocols := protocolsOf(rs, universe)
+	inwk := pieces(rs, dims, protocols)
+
+	// a rule of any in universe is only of the protocols of no other rule of universe
+	declared := make(map[space]bool)
+	for _, r := range universe {
+		if !isAnyProtocol(r.Protocol) {
+			declared[r.space()] = true
+		}
+	}
+	var uwk []piece
+	for _, e := range pieces(universe, dims, protocols) {
+		if !e.copied || !declared[e.r.space()] {
+			uwk = append(uwk, e)
+		}
+	}
+
+	all := append(append([]piece{}, uwk...), inwk...)
+	n := len(uwk)
+	overlapping := make([][]int, len(uwk))
+	for _, p := range intersectingPairs(all, func(i, k int) bool { return (i < n) != (k < n) }) {
+		u, i := min(p[0], p[1]), max(p[0], p[1])-n
+		overlapping[u] = append(overlapping[u], i)
+	}
+
+	// the gaps of any are only of the other protocols, so each space is resolved apart
+	gaps := make(map[space]RuleSet)
+	var keys []space
+	for u, e := range uwk {
+		sort.Ints(overlapping[u])
+		for _, b := range minusAll([]Box{e.b}, inwk, overlapping[u]) {
+			r := e.r
+			r.setBox(dims, b)
+			if _, found := gaps[r.space()]; !found {
+				keys = append(keys, r.space())
+			}
+			gaps[r.space()] = append(gaps[r.space()], r)
+		}
+	}
+
+	var result RuleSet
+	for _, s := range keys {
+		result = append(result, gaps[s].Resolve(dims)...)
+	}
+	return result
+}
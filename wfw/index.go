@@ -0,0 +1,86 @@
+package wfw
+
+import (
+	"sort"
+)
+
+// intersectingPairs returns the pairs of indices of wk whose boxes intersect
+// and which satisfy match(i, k), in the same space.
+//
+// In each space, the boxes are swept along the dimension in which they overlap least,
+// keeping only the boxes that reach the sweep line,
+// so that the cost is close to the number of the pairs overlapping in that dimension
+// rather than the square of the number of the boxes.
+func intersectingPairs(wk []piece, match func(i, k int) bool) [][2]int {
+	spaces := make(map[space][]int)
+	var keys []space
+	for i, e := range wk {
+		s := e.r.space()
+		if _, found := spaces[s]; !found {
+			keys = append(keys, s)
+		}
+		spaces[s] = append(spaces[s], i)
+	}
+
+	var pairs [][2]int
+	for _, s := range keys {
+		idx := spaces[s]
+		if len(idx) < 2 {
+			continue
+		}
+
+		d := sweepDimension(wk, idx)
+		sort.SliceStable(idx, func(i, j int) bool {
+			return wk[idx[i]].b[d].Start.Less(wk[idx[j]].b[d].Start)
+		})
+
+		var active []int
+		for _, k := range idx {
+			start := wk[k].b[d].Start
+
+			// drop the boxes behind the sweep line
+			reaching := active[:0]
+			for _, i := range active {
+				if !wk[i].b[d].End.Less(start) {
+					reaching = append(reaching, i)
+				}
+			}
+			active = reaching
+
+			for _, i := range active {
+				if match(i, k) && wk[i].b.intersects(wk[k].b) {
+					pairs = append(pairs, [2]int{i, k})
+				}
+			}
+			active = append(active, k)
+		}
+	}
+	return pairs
+}
+
+// sweepDimension returns the dimension in which the boxes of idx overlap least.
+func sweepDimension(wk []piece, idx []int) int {
+	best, bestCount := 0, -1
+	for d := range wk[idx[0]].b {
+		starts := make([]int, len(idx))
+		ends := make([]int, len(idx))
+		for i := range idx {
+			starts[i], ends[i] = idx[i], idx[i]
+		}
+		sort.Slice(starts, func(i, j int) bool { return wk[starts[i]].b[d].Start.Less(wk[starts[j]].b[d].Start) })
+		sort.Slice(ends, func(i, j int) bool { return wk[ends[i]].b[d].End.Less(wk[ends[j]].b[d].End) })
+
+		// the number of the boxes starting before i ends, but those ending before i starts
+		count := 0
+		for _, i := range idx {
+			r := wk[i].b[d]
+			count += sort.Search(len(starts), func(j int) bool { return r.End.Less(wk[starts[j]].b[d].Start) })
+			count -= sort.Search(len(ends), func(j int) bool { return !wk[ends[j]].b[d].End.Less(r.Start) })
+		}
+
+		if bestCount < 0 || count < bestCount {
+			best, bestCount = d, count
+		}
+	}
+	return best
+}
@@ -0,0 +1,102 @@
+package wfw
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/shu-go/rng"
+)
+
+// IPv6 is a rng.Sequential of IPv6 addresses, in the same manner as rng.IPv4.
+// Each element is a 16-bit group.
+type IPv6 [8]int
+
+func (s IPv6) Next() rng.Sequential {
+	ip := s
+	if ip == (IPv6{0xffff, 0xffff, 0xffff, 0xffff, 0xffff, 0xffff, 0xffff, 0xffff}) {
+		return s
+	}
+
+	for i := range ip {
+		if ip[7-i] == 0xffff {
+			ip[7-i] = 0
+		} else {
+			ip[7-i]++
+			break
+		}
+	}
+
+	return ip
+}
+
+func (s IPv6) Prev() rng.Sequential {
+	ip := s
+	if ip == (IPv6{}) {
+		return s
+	}
+
+	for i := range ip {
+		if ip[7-i] <= 0 {
+			ip[7-i] = 0xffff
+		} else {
+			ip[7-i]--
+			break
+		}
+	}
+
+	return ip
+}
+
+func (s IPv6) Less(b rng.Sequential) bool {
+	if bb, ok := b.(IPv6); ok {
+		for i := range s {
+			if s[i] < bb[i] {
+				return true
+			} else if s[i] > bb[i] {
+				return false
+			}
+		}
+	}
+	return false
+}
+
+func (s IPv6) Equal(b rng.Sequential) bool {
+	if bb, ok := b.(IPv6); ok {
+		return s == bb
+	}
+	return false
+}
+
+// String returns the canonical (compressed) form such as "fe80::1".
+func (s IPv6) String() string {
+	var b [16]byte
+	for i, g := range s {
+		b[i*2] = byte(g >> 8)
+		b[i*2+1] = byte(g)
+	}
+	return netip.AddrFrom16(b).String()
+}
+
+// NewIPv6 parses s like rng.NewIPv4 does.
+// It panics if s is not an IPv6 address.
+func NewIPv6(s string) IPv6 {
+	addr, err := netip.ParseAddr(s)
+	if err != nil || !addr.Is6() {
+		panic(fmt.Sprintf("%s", s))
+	}
+
+	b := addr.As16()
+	var ip IPv6
+	for i := range ip {
+		ip[i] = int(b[i*2])<<8 | int(b[i*2+1])
+	}
+	return ip
+}
+
+// Family returns the address family (4 or 6) of an IP sequential.
+func Family(s rng.Sequential) int {
+	if _, ok := s.(IPv6); ok {
+		return 6
+	}
+	return 4
+}
@@ -0,0 +1,127 @@
+package wfw
+
+import (
+	"sort"
+)
+
+// Shadowing is how much of a rule is decided by earlier rules.
+type Shadowing int
+
+const (
+	NotShadowed Shadowing = iota
+
+	// PartiallyShadowed rules are partly decided by earlier rules of the opposite action.
+	PartiallyShadowed
+
+	// Shadowed rules are fully decided by earlier rules, some of which are of the opposite action.
+	Shadowed
+
+	// Redundant rules are fully decided by earlier rules of the same action.
+	Redundant
+)
+
+func (s Shadowing) String() string {
+	switch s {
+	case PartiallyShadowed:
+		return "partially shadowed"
+	case Shadowed:
+		return "shadowed"
+	case Redundant:
+		return "redundant"
+	}
+	return "not shadowed"
+}
+
+// Finding is a result of Lint on the rules of a Tag.
+type Finding struct {
+	Tag       int
+	Shadowing Shadowing
+
+	// By are the tags of the earlier rules deciding packets of the rules,
+	// of the opposite action unless Redundant.
+	By []int
+}
+
+// Lint reports rules decided by earlier rules, in the first-match interpretation of rs.
+// Rules of a Tag are reported together, in order of Tag.
+func (rs RuleSet) Lint() []Finding {
+	wk := pieces(rs, Dimensions(false), protocolsOf(rs))
+	firsts, earlier := firstRegions(wk)
+
+	type state struct {
+		effective bool
+		opposite  map[int]bool
+		same      map[int]bool
+	}
+	states := make(map[int]*state)
+	var tags []int
+
+	for k, e := range wk {
+		st, found := states[e.r.Tag]
+		if !found {
+			st = &state{opposite: make(map[int]bool), same: make(map[int]bool)}
+			states[e.r.Tag] = st
+			tags = append(tags, e.r.Tag)
+		}
+
+		if len(firsts[k]) > 0 {
+			st.effective = true
+		}
+
+		for _, i := range earlier[k] {
+			if wk[i].r.Tag == e.r.Tag {
+				continue
+			}
+
+			deciding := false
+			for _, b := range firsts[i] {
+				if b.intersects(e.b) {
+					deciding = true
+					break
+				}
+			}
+			if !deciding {
+				continue
+			}
+
+			if wk[i].r.Allow != e.r.Allow {
+				st.opposite[wk[i].r.Tag] = true
+			} else {
+				st.same[wk[i].r.Tag] = true
+			}
+		}
+	}
+
+	sort.Ints(tags)
+
+	var findings []Finding
+	for _, t := range tags {
+		st := states[t]
+
+		f := Finding{Tag: t}
+		switch {
+		case len(st.opposite) > 0 && st.effective:
+			f.Shadowing = PartiallyShadowed
+			f.By = sortedKeys(st.opposite)
+		case len(st.opposite) > 0:
+			f.Shadowing = Shadowed
+			f.By = sortedKeys(st.opposite)
+		case !st.effective && len(st.same) > 0:
+			f.Shadowing = Redundant
+			f.By = sortedKeys(st.same)
+		default:
+			continue
+		}
+		findings = append(findings, f)
+	}
+	return findings
+}
+
+func sortedKeys(m map[int]bool) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
@@ -0,0 +1,83 @@
+package wfw
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Model is how a rule set decides a packet matched by some of its rules.
+type Model int
+
+const (
+	// FirstMatchModel lets the first matching rule decide.
+	FirstMatchModel Model = iota
+
+	// LastMatchModel lets the last matching rule decide.
+	LastMatchModel
+
+	// BlockWinsModel lets any matching block rule decide, regardless of the order,
+	// as Windows Firewall does.
+	BlockWinsModel
+)
+
+var modelNames = []string{"first-match", "last-match", "block-wins"}
+
+func (m Model) String() string {
+	if m < 0 || int(m) >= len(modelNames) {
+		return fmt.Sprintf("Model(%d)", int(m))
+	}
+	return modelNames[m]
+}
+
+// ModelByName returns a Model named name (first-match, last-match or block-wins).
+func ModelByName(name string) (Model, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, n := range modelNames {
+		if n == name {
+			return Model(i), true
+		}
+	}
+	return 0, false
+}
+
+// Match returns the index of the rule of rs deciding the packet a in m, or -1.
+func (m Model) Match(rs RuleSet, a Rule) int {
+	switch m {
+	case LastMatchModel:
+		return rs.LastMatch(a)
+	case BlockWinsModel:
+		return rs.BlockWins(a)
+	}
+	return rs.FirstMatch(a)
+}
+
+// Ordered returns rs reordered so that its first matching rule decides as m does.
+// Rule sets in the other models can be passed to the functions working in first-match,
+// such as Resolve, Verify, Lint and Diff, through Ordered.
+func (m Model) Ordered(rs RuleSet) RuleSet {
+	result := make(RuleSet, 0, len(rs))
+
+	switch m {
+	case LastMatchModel:
+		for i := len(rs) - 1; i >= 0; i-- {
+			result = append(result, rs[i])
+		}
+
+	case BlockWinsModel:
+		for _, r := range rs {
+			if !r.Allow {
+				result = append(result, r)
+			}
+		}
+		for _, r := range rs {
+			if r.Allow {
+				result = append(result, r)
+			}
+		}
+
+	default:
+		result = append(result, rs...)
+	}
+
+	return result
+}
@@ -0,0 +1,67 @@
+package wfw
+
+import "strings"
+
+// Profile is a set of firewall profiles.
+// The zero value means any profile.
+type Profile int
+
+const (
+	ProfileDomain Profile = 1 << iota
+	ProfilePrivate
+	ProfilePublic
+
+	ProfileAny = ProfileDomain | ProfilePrivate | ProfilePublic
+)
+
+var profileNames = []struct {
+	p    Profile
+	name string
+}{
+	{ProfileDomain, "domain"},
+	{ProfilePrivate, "private"},
+	{ProfilePublic, "public"},
+}
+
+// Set returns p as a set, in which the zero value is expanded to ProfileAny.
+func (p Profile) Set() Profile {
+	if p == 0 {
+		return ProfileAny
+	}
+	return p & ProfileAny
+}
+
+// Contains reports whether p contains all profiles of a.
+func (p Profile) Contains(a Profile) bool {
+	return p.Set()&a.Set() == a.Set()
+}
+
+// String returns a comma-separated list such as "domain,private", or "any".
+func (p Profile) String() string {
+	p = p.Set()
+	if p == ProfileAny {
+		return "any"
+	}
+
+	var names []string
+	for _, pn := range profileNames {
+		if p&pn.p != 0 {
+			names = append(names, pn.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ProfileByName returns a Profile named name (domain, private, public or any).
+func ProfileByName(name string) (Profile, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "any" {
+		return ProfileAny, true
+	}
+	for _, pn := range profileNames {
+		if pn.name == name {
+			return pn.p, true
+		}
+	}
+	return 0, false
+}
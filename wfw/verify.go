@@ -0,0 +1,198 @@
+package wfw
+
+import (
+	"sort"
+
+	"github.com/shu-go/rng"
+)
+
+// Decision is what a rule set does to a packet.
+type Decision int
+
+const (
+	NoMatch Decision = iota
+	Allowed
+	Blocked
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allowed:
+		return "allow"
+	case Blocked:
+		return "block"
+	}
+	return "no match"
+}
+
+// DecisionOf returns the decision of r on the packets it matches.
+func DecisionOf(r Rule) Decision {
+	if r.Allow {
+		return Allowed
+	}
+	return Blocked
+}
+
+// Counterexample is a packet on which two rule sets decide differently.
+type Counterexample struct {
+	// Packet is a rule matching only the packet.
+	Packet Rule
+
+	Want, Got Decision
+
+	// WantRule and GotRule are the rules deciding the packet, nil if NoMatch.
+	WantRule, GotRule *Rule
+}
+
+// Verify checks that out decides every packet as in does.
+//
+// in is interpreted by its first matching rule,
+// and out by block-wins, as Windows Firewall does.
+// Verify returns nil if they are equivalent, otherwise a Counterexample.
+func Verify(in, out RuleSet, dims []Dimension) *Counterexample {
+	protocols := protocolsOf(in, out)
+	inwk := pieces(in, dims, protocols)
+	outwk := pieces(out, dims, protocols)
+
+	firsts, _ := firstRegions(inwk)
+
+	// the regions of in where each rule matches first, and the rules of out
+	var all []piece
+	for k, bb := range firsts {
+		for _, b := range bb {
+			all = append(all, piece{r: inwk[k].r, b: b})
+		}
+	}
+	n := len(all)
+	all = append(all, outwk...)
+
+	// overlaps between the regions of in and the rules of out
+	overlapping := make([][]int, n)
+	for _, p := range intersectingPairs(all, func(i, k int) bool { return (i < n) != (k < n) }) {
+		i, k := min(p[0], p[1]), max(p[0], p[1])
+		overlapping[i] = append(overlapping[i], k-n)
+	}
+
+	for f, e := range all[:n] {
+		sort.Ints(overlapping[f])
+		var blocks, allows []int
+		for _, o := range overlapping[f] {
+			if outwk[o].r.Allow {
+				allows = append(allows, o)
+			} else {
+				blocks = append(blocks, o)
+			}
+		}
+
+		if e.r.Allow {
+			// no block in the allowed region
+			for _, o := range blocks {
+				if c, intersecting := e.b.Intersection(outwk[o].b); intersecting {
+					return counterexample(e.r, dims, c, in, out)
+				}
+			}
+			if rest := minusAll([]Box{e.b}, outwk, allows); len(rest) > 0 {
+				return counterexample(e.r, dims, rest[0], in, out)
+			}
+		} else {
+			if rest := minusAll([]Box{e.b}, outwk, blocks); len(rest) > 0 {
+				return counterexample(e.r, dims, rest[0], in, out)
+			}
+		}
+	}
+
+	// overlaps between the rules of in and out
+	all = append(append([]piece{}, inwk...), outwk...)
+	n = len(inwk)
+	outOverlapping := make([][]int, len(outwk))
+	for _, p := range intersectingPairs(all, func(i, k int) bool { return (i < n) != (k < n) }) {
+		i, k := min(p[0], p[1]), max(p[0], p[1])
+		outOverlapping[k-n] = append(outOverlapping[k-n], i)
+	}
+
+	// nothing in out outside in
+	for o, e := range outwk {
+		if rest := minusAll([]Box{e.b}, inwk, outOverlapping[o]); len(rest) > 0 {
+			return counterexample(e.r, dims, rest[0], in, out)
+		}
+	}
+
+	return nil
+}
+
+// firstRegions returns the regions where each of wk matches first,
+// and the indices of the earlier ones overlapping each of wk.
+func firstRegions(wk []piece) (firsts [][]Box, earlier [][]int) {
+	firsts = make([][]Box, len(wk))
+	earlier = make([][]int, len(wk))
+	for _, p := range intersectingPairs(wk, func(i, k int) bool { return true }) {
+		i, k := min(p[0], p[1]), max(p[0], p[1])
+		earlier[k] = append(earlier[k], i)
+	}
+	for k := range wk {
+		sort.Ints(earlier[k])
+		firsts[k] = minusAll([]Box{wk[k].b}, wk, earlier[k])
+	}
+	return firsts, earlier
+}
+
+// minusAll returns the parts of bb outside wk[idx].
+func minusAll(bb []Box, wk []piece, idx []int) []Box {
+	var result []Box
+	for _, b := range bb {
+		result = boxMinusAll(result, b, wk, idx)
+	}
+	return result
+}
+
+// boxMinusAll appends the parts of b outside wk[idx] to result.
+// As piece.minusAll, each part is passed only the rest of idx overlapping it.
+func boxMinusAll(result []Box, b Box, wk []piece, idx []int) []Box {
+	for n, i := range idx {
+		if !b.intersects(wk[i].b) {
+			continue
+		}
+		rest := idx[n+1:]
+		for _, e := range b.Minus(wk[i].b) {
+			var overlapping []int
+			for _, o := range rest {
+				if e.intersects(wk[o].b) {
+					overlapping = append(overlapping, o)
+				}
+			}
+			result = boxMinusAll(result, e, wk, overlapping)
+		}
+		return result
+	}
+	return append(result, b)
+}
+
+// counterexample returns a Counterexample at the first point of b in the space of r.
+func counterexample(r Rule, dims []Dimension, b Box, in, out RuleSet) *Counterexample {
+	p := make(Box, len(b))
+	for d := range b {
+		p[d] = rng.NewRange(b[d].Start, b[d].Start)
+	}
+
+	packet := Rule{
+		Direction:  r.Direction,
+		Protocol:   r.Protocol,
+		Profile:    r.Profile,
+		Port:       r.Port,
+		IP:         r.IP,
+		RemotePort: r.RemotePort,
+		LocalIP:    r.LocalIP,
+	}
+	packet.setBox(dims, p)
+
+	ce := Counterexample{Packet: packet}
+	if i := in.FirstMatch(packet); i >= 0 {
+		ce.WantRule = &in[i]
+		ce.Want = DecisionOf(in[i])
+	}
+	if i := out.BlockWins(packet); i >= 0 {
+		ce.GotRule = &out[i]
+		ce.Got = DecisionOf(out[i])
+	}
+	return &ce
+}
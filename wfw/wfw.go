@@ -1,7 +1,9 @@
 package wfw
 
 import (
+	"fmt"
 	"sort"
+	"strings"
 
 	"github.com/shu-go/orderedmap"
 	"github.com/shu-go/rng"
@@ -10,11 +12,21 @@ import (
 type Rule struct {
 	Name, Desc string
 
-	Protocol string
+	// Group is kept by the fragments of the rule.
+	// Rules of different groups are not joined.
+	Group string
+
+	Direction string // "in" or "out"
+	Protocol  string
+	Profile   Profile
 
 	Allow bool
-	Port  rng.Range
-	IP    rng.Range
+	Port  rng.Range // local port
+	IP    rng.Range // remote IP
+
+	// The zero values mean any.
+	RemotePort rng.Range
+	LocalIP    rng.Range
 
 	Original bool
 	Excepts  *orderedmap.OrderedMap[ /*Tag*/ int, bool]
@@ -23,7 +35,11 @@ type Rule struct {
 }
 
 func (r Rule) Equal(a Rule) bool {
-	if r.Protocol != a.Protocol {
+	if r.Direction != a.Direction {
+		return false
+	}
+
+	if !strings.EqualFold(r.Protocol, a.Protocol) {
 		return false
 	}
 
@@ -31,6 +47,10 @@ func (r Rule) Equal(a Rule) bool {
 		return false
 	}
 
+	if r.Profile.Set() != a.Profile.Set() {
+		return false
+	}
+
 	if !r.Port.Equal(a.Port) {
 		return false
 	}
@@ -39,309 +59,770 @@ func (r Rule) Equal(a Rule) bool {
 		return false
 	}
 
-	return true
-}
+	if !r.remotePort().Equal(a.remotePort()) {
+		return false
+	}
 
-type RuleSet []Rule
+	if !r.localIP().Equal(a.localIP()) {
+		return false
+	}
 
-func (rs RuleSet) Hoge(portfirstjoin bool) RuleSet {
-	/*
-	 * r0
-	 * r1  <--+-(1) wki
-	 * r2  <--+     wkk
-	 */
+	return true
+}
 
-	/*
-	 * r0    <--+-(2) wki
-	 * r1    *--+     wkk
-	 * r2    *--+     wkk
-	 * r2-1  *--+     wkk
-	 */
+// Contains reports whether r matches every packet a matches.
+// Protocols are compared case-insensitively, and any contains every protocol.
+func (r Rule) Contains(a Rule) bool {
+	if r.Direction != a.Direction || !(isAnyProtocol(r.Protocol) || strings.EqualFold(r.Protocol, a.Protocol)) || Family(r.IP.Start) != Family(a.IP.Start) {
+		return false
+	}
 
-	wk := make(RuleSet, len(rs))
-	copy(wk, rs)
+	for _, dim := range Dimensions(false) {
+		rr := dim.Ranges(r)
+		for _, v := range dim.Ranges(a) {
+			contained := false
+			for _, e := range rr {
+				if e.ContainsRange(v) {
+					contained = true
+					break
+				}
+			}
+			if !contained {
+				return false
+			}
+		}
+	}
 
-	for i := 0; i < len(wk); i++ {
-		wki := wk[i]
+	return true
+}
 
-		//rog.Print("")
-		//rog.Printf("wki: %#v", wki)
+// Intersects reports whether some packet matches both r and a.
+// Protocols are compared case-insensitively, and any intersects every protocol.
+func (r Rule) Intersects(a Rule) bool {
+	if r.Direction != a.Direction || !protocolsIntersect(r.Protocol, a.Protocol) || Family(r.IP.Start) != Family(a.IP.Start) {
+		return false
+	}
 
-		var wki2d rng.Range2D
-		if portfirstjoin {
-			wki2d = rng.NewRange2D(wki.Port.Start, wki.Port.End, wki.IP.Start, wki.IP.End)
-		} else {
-			wki2d = rng.NewRange2D(wki.IP.Start, wki.IP.End, wki.Port.Start, wki.Port.End)
+	for _, dim := range Dimensions(false) {
+		intersecting := false
+		for _, v := range dim.Ranges(a) {
+			for _, e := range dim.Ranges(r) {
+				if e.IsIntersecting(v) {
+					intersecting = true
+					break
+				}
+			}
+		}
+		if !intersecting {
+			return false
 		}
+	}
 
-		for k := len(wk) - 1; k > i; k-- {
-			wkk := wk[k]
+	return true
+}
 
-			//rog.Print("")
-			//rog.Printf("  wkk: %#v", wkk)
+// isAnyProtocol reports whether p is any, which matches every protocol.
+func isAnyProtocol(p string) bool {
+	return strings.EqualFold(p, "any")
+}
 
-			if wki.Protocol == wkk.Protocol {
-				if wki.Allow == wkk.Allow {
-					continue
-				}
+// protocolsIntersect reports whether some packet is of both p and q.
+func protocolsIntersect(p, q string) bool {
+	return isAnyProtocol(p) || isAnyProtocol(q) || strings.EqualFold(p, q)
+}
 
-				var wkk2d rng.Range2D
-				if portfirstjoin {
-					wkk2d = rng.NewRange2D(wkk.Port.Start, wkk.Port.End, wkk.IP.Start, wkk.IP.End)
-				} else {
-					wkk2d = rng.NewRange2D(wkk.IP.Start, wkk.IP.End, wkk.Port.Start, wkk.Port.End)
-				}
-				tmp2d := wkk2d.Minus(wki2d, false /*no join*/)
-				tmpIsOrig := (len(tmp2d) == 1 && tmp2d[0].R1.Equal(wkk2d.R1) && tmp2d[0].R2.Equal(wkk2d.R2))
-				tmp := make([]Rule, 0, len(tmp2d))
-				for _, e := range tmp2d {
-					//rog.Printf("    e: %#v", e)
-
-					excepts := wkk.Excepts
-
-					var ipexcept, portexcept bool
-					if portfirstjoin {
-						portexcept = !e.R1.Equal(wkk2d.R1) && !e.R1.Equal(wki2d.R1)
-						ipexcept = !e.R2.Equal(wkk2d.R2) && !e.R2.Equal(wki2d.R2)
-					} else {
-						portexcept = !e.R2.Equal(wkk2d.R2) && !e.R2.Equal(wki2d.R2)
-						ipexcept = !e.R1.Equal(wkk2d.R1) && !e.R1.Equal(wki2d.R1)
-					}
-					//rog.Printf("      portexcept=%v, ipexcept=%v", portexcept, ipexcept)
-
-					if !tmpIsOrig && wki.Original && (ipexcept || portexcept) {
-						excepts = orderedmap.New[int, bool]()
-						if wkk.Excepts != nil {
-							// copy
-							for _, k := range wkk.Excepts.Keys() {
-								excepts.Set(k, wkk.Excepts.GetDefault(k, false))
-							}
-						}
-
-						if e, found := excepts.Get(wki.Tag); found {
-							excepts.Set(wki.Tag, e || ipexcept || portexcept)
-						} else {
-							excepts.Set(wki.Tag, ipexcept || portexcept)
-						}
-					}
-					//rog.Printf("      excepts=%#v", excepts)
-
-					if portfirstjoin {
-						tmp = append(tmp, Rule{
-							Name:     wkk.Name,
-							Desc:     wkk.Desc,
-							Allow:    wkk.Allow,
-							Protocol: wkk.Protocol,
-							Port:     rng.NewRange(e.R1.Start, e.R1.End),
-							IP:       rng.NewRange(e.R2.Start, e.R2.End),
-							Original: tmpIsOrig,
-							Excepts:  excepts,
-							Tag:      wkk.Tag,
-						})
-
-					} else {
-						tmp = append(tmp, Rule{
-							Name:     wkk.Name,
-							Desc:     wkk.Desc,
-							Allow:    wkk.Allow,
-							Protocol: wkk.Protocol,
-							Port:     rng.NewRange(e.R2.Start, e.R2.End),
-							IP:       rng.NewRange(e.R1.Start, e.R1.End),
-							Original: tmpIsOrig,
-							Excepts:  excepts,
-							Tag:      wkk.Tag,
-						})
-					}
-				}
-				wk = append(wk[:k], append(tmp, wk[k+1:]...)...)
-				k += len(tmp) - 1
+// hasPorts reports whether packets of p have ports.
+// Rules of the other protocols match any port, whatever their Port and RemotePort are.
+func hasPorts(p string) bool {
+	return strings.EqualFold(p, "tcp") || strings.EqualFold(p, "udp")
+}
+
+// protocolsOf returns the protocols of rss other than any, in their first spellings,
+// ordered case-insensitively.
+func protocolsOf(rss ...RuleSet) []string {
+	seen := make(map[string]bool)
+	var protocols []string
+	for _, rs := range rss {
+		for _, r := range rs {
+			if p := strings.ToLower(r.Protocol); !isAnyProtocol(p) && !seen[p] {
+				seen[p] = true
+				protocols = append(protocols, r.Protocol)
 			}
 		}
 	}
+	sort.Slice(protocols, func(i, j int) bool { return strings.ToLower(protocols[i]) < strings.ToLower(protocols[j]) })
+	return protocols
+}
 
-	// remove each rule contained in another rule
-	for i := len(wk) - 1; i >= 0; i-- {
-		contained := false
-		for k := 0; k < len(wk); k++ {
-			if i == k {
-				continue
-			}
+// AnyPort is the range of all ports.
+var AnyPort = rng.NewRange(rng.Int(0), rng.Int(65535))
 
-			if wk[i].Protocol == wk[k].Protocol && wk[i].Allow == wk[k].Allow &&
-				wk[k].Port.ContainsRange(wk[i].Port) && wk[k].IP.ContainsRange(wk[i].IP) {
-				//
-				contained = true
-				break
-			}
+// AnyIP returns the range of all addresses of the family (4 or 6).
+func AnyIP(family int) rng.Range {
+	if family == 6 {
+		return rng.NewRange(IPv6{}, IPv6{0xffff, 0xffff, 0xffff, 0xffff, 0xffff, 0xffff, 0xffff, 0xffff})
+	}
+	return rng.NewRange(rng.IPv4{0, 0, 0, 0}, rng.IPv4{255, 255, 255, 255})
+}
+
+func (r Rule) remotePort() rng.Range {
+	if r.RemotePort.Start == nil {
+		return AnyPort
+	}
+	return r.RemotePort
+}
+
+func (r Rule) localIP() rng.Range {
+	if r.LocalIP.Start == nil {
+		return AnyIP(Family(r.IP.Start))
+	}
+	return r.LocalIP
+}
+
+// box returns the match space of r in dims.
+// r must have been expanded, so that it has one range in each dimension.
+func (r Rule) box(dims []Dimension) Box {
+	b := make(Box, len(dims))
+	for d, dim := range dims {
+		b[d] = dim.Ranges(r)[0]
+	}
+	return b
+}
+
+func (r *Rule) setBox(dims []Dimension, b Box) {
+	for d, dim := range dims {
+		dim.SetRange(r, b[d])
+	}
+}
+
+// expand splits r into rules with one range in each dimension.
+func (r Rule) expand(dims []Dimension) RuleSet {
+	rs := RuleSet{r}
+	for _, dim := range dims {
+		rr := dim.Ranges(r)
+		if len(rr) == 1 {
+			continue
 		}
-		if contained {
-			wk = append(wk[:i], wk[i+1:]...)
+
+		tmp := make(RuleSet, 0, len(rs)*len(rr))
+		for _, e := range rs {
+			for _, v := range rr {
+				dim.SetRange(&e, v)
+				tmp = append(tmp, e)
+			}
 		}
+		rs = tmp
 	}
+	return rs
+}
 
-	// join primary
+// space is the key of rules which can overlap.
+// Rules of different directions, protocols or address families never do,
+// once rules of protocol any are copied into the other protocols (see pieces).
+type space struct {
+	direction, protocol string
+	family              int
+}
 
-	wk.Sort(portfirstjoin)
+// space returns the space of r. Protocols are lowercased, as Contains and Intersects ignore their case.
+func (r Rule) space() space {
+	return space{direction: r.Direction, protocol: strings.ToLower(r.Protocol), family: Family(r.IP.Start)}
+}
 
-	anyjoined := true
-	for anyjoined {
-		anyjoined = false
-		delidx := -1
+// sameSpace reports whether r and a can overlap.
+func (r Rule) sameSpace(a Rule) bool {
+	return r.space() == a.space()
+}
 
-	findloop:
-		for i := len(wk) - 2; i >= 0; i-- {
-			for k := len(wk) - 1; k > i; k-- {
-				if wk[i].Protocol != wk[k].Protocol || wk[i].Allow != wk[k].Allow {
-					continue
-				}
+type RuleSet []Rule
 
-				//rog.Print(i, k, wk[i].IP, wk[k].IP, wk[i].Port, wk[k].Port)
-				if portfirstjoin {
-					if wk[i].Port.Equal(wk[k].Port) && wk[i].IP.End.Next().Equal(wk[k].IP.Start) {
-						wk[i].IP.End = wk[k].IP.End
-						delidx = k
-						anyjoined = true
-						break findloop
-					}
-				} else {
-					if wk[i].IP.Equal(wk[k].IP) && wk[i].Port.End.Next().Equal(wk[k].Port.Start) {
-						wk[i].Port.End = wk[k].Port.End
-						delidx = k
-						anyjoined = true
-						//rog.Print("  JOIN")
-						//rog.Print(i, wk[i].IP, wk[i].Port)
-						break findloop
-					}
-				}
-			}
+// FirstMatch returns the index of the first rule containing the packet a, or -1.
+func (rs RuleSet) FirstMatch(a Rule) int {
+	for i, r := range rs {
+		if r.Contains(a) {
+			return i
 		}
+	}
+	return -1
+}
 
-		if anyjoined {
-			wk = append(wk[:delidx], wk[delidx+1:]...)
+// LastMatch returns the index of the last rule containing the packet a, or -1.
+func (rs RuleSet) LastMatch(a Rule) int {
+	for i := len(rs) - 1; i >= 0; i-- {
+		if rs[i].Contains(a) {
+			return i
 		}
 	}
+	return -1
+}
 
-	// join secondary
+// BlockWins returns the index of the first block rule containing the packet a,
+// otherwise that of the first allow rule, or -1.
+// This is how Windows Firewall decides.
+func (rs RuleSet) BlockWins(a Rule) int {
+	allow := -1
+	for i, r := range rs {
+		if !r.Contains(a) {
+			continue
+		}
+		if !r.Allow {
+			return i
+		}
+		if allow < 0 {
+			allow = i
+		}
+	}
+	return allow
+}
 
-	wk.Sort(!portfirstjoin)
+// Hoge resolves rs, interpreted in the model m, by Resolve with Dimensions(portfirstjoin).
+// The result decides every packet in block-wins, as Windows Firewall does, as rs does in m.
+func (rs RuleSet) Hoge(portfirstjoin bool, m Model) RuleSet {
+	return m.Ordered(rs).Resolve(Dimensions(portfirstjoin))
+}
 
-	anyjoined = true
-	for anyjoined {
-		anyjoined = false
-		delidx := -1
+// Resolve returns rules equivalent to rs, in which each rule is
+// preceded by no rule of the opposite action overlapping it,
+// so that the result does not depend on the order of rules.
+//
+// Rules of protocol any match every protocol (see pieces).
+// An allow of any may still overlap blocks of other protocols, which win over it in block-wins.
+// A block of any cannot block the other protocols where rs allows some protocol,
+// so the other protocols are left unmatched there.
+//
+// dims are ordered by the priority of joining;
+// the resulting rules are joined in the 2nd dimension, then in the 1st, and then in the rest.
+//
+// Overlapping rules are found by sweeping (see intersectingPairs),
+// so that rules far from each other cost nothing.
+func (rs RuleSet) Resolve(dims []Dimension) RuleSet {
+	wk := pieces(rs, dims, protocolsOf(rs))
+	wk = subtract(wk, dims)
+	wk = dropCopies(wk)
+	wk = removeContained(wk)
+
+	wk = joinAll(wk, dims, true)
+
+	// uniting makes rules equal in the other dimensions, and so adjacent
+	united := false
+	for d, dim := range dims {
+		if u, ok := dim.(Uniter); ok {
+			wk = unite(wk, d, u)
+			united = true
+		}
+	}
+	if united {
+		wk = joinAll(wk, dims, false)
+	}
 
-	findloop2:
-		for i := len(wk) - 2; i >= 0; i-- {
-			for k := len(wk) - 1; k > i; k-- {
-				if wk[i].Protocol != wk[k].Protocol || wk[i].Allow != wk[k].Allow {
-					continue
-				}
+	result := make(RuleSet, 0, len(wk))
+	for _, e := range wk {
+		if len(e.cutters) > 0 {
+			e.r.Excepts = exceptsOf(e.cutters)
+		}
+		result = append(result, e.r)
+	}
+	return result
+}
 
-				if portfirstjoin {
-					if wk[i].IP.Equal(wk[k].IP) && wk[i].Port.End.Next().Equal(wk[k].Port.Start) {
-						wk[i].Port.End = wk[k].Port.End
-						delidx = k
-						anyjoined = true
-						break findloop2
-					}
-				} else {
-					if wk[i].Port.Equal(wk[k].Port) && wk[i].IP.End.Next().Equal(wk[k].IP.Start) {
-						wk[i].IP.End = wk[k].IP.End
-						delidx = k
-						anyjoined = true
-						break findloop2
-					}
-				}
+// joinAll joins wk in the 2nd dimension, then in the 1st, and then in the rest.
+// Unless uniters, Uniter dimensions are skipped, as their boxes may be keys (see unite).
+func joinAll(wk []piece, dims []Dimension, uniters bool) []piece {
+	order := joinOrder(len(dims))
+	if !uniters {
+		tmp := order[:0:0]
+		for _, d := range order {
+			if _, ok := dims[d].(Uniter); !ok {
+				tmp = append(tmp, d)
 			}
 		}
+		order = tmp
+	}
+	if len(order) == 0 {
+		return wk
+	}
 
-		if anyjoined {
-			wk = append(wk[:delidx], wk[delidx+1:]...)
-		}
+	// join primary
+	sortPieces(wk, identity(len(dims)))
+	wk = join(wk, dims, order[0])
+
+	// join secondary, and the rest
+	sortPieces(wk, order)
+	for _, d := range order[1:] {
+		wk = join(wk, dims, d)
 	}
 
 	return wk
 }
 
-func (rs *RuleSet) Sort(portfirst bool) {
-	sort.Slice(*rs, func(i, j int) bool {
-		rsi := (*rs)[i]
-		rsj := (*rs)[j]
+// piece is a rule with its box.
+type piece struct {
+	r Rule
+	b Box
 
-		if rsi.Protocol < rsj.Protocol {
-			return true
-		}
-		if rsj.Protocol < rsi.Protocol {
-			return false
-		}
+	// the original rules which cut the rule, and touch the piece
+	cutters []cut
+
+	// copied is true if r is a copy of a rule of protocol any (see pieces)
+	copied bool
+}
+
+// cut is an original rule which cut another rule.
+type cut struct {
+	tag int
+	b   Box
+}
+
+// exceptsOf returns the tags of cutters as Excepts, in ascending order.
+func exceptsOf(cutters []cut) *orderedmap.OrderedMap[int, bool] {
+	tags := make([]int, 0, len(cutters))
+	for _, c := range cutters {
+		tags = append(tags, c.tag)
+	}
+	sort.Ints(tags)
+
+	excepts := orderedmap.New[int, bool]()
+	for _, t := range tags {
+		excepts.Set(t, true)
+	}
+	return excepts
+}
 
-		if rsi.Tag < rsj.Tag {
-			return true
+// pieces expands rs into pieces.
+//
+// A rule of protocol any is also copied into each of protocols, matching all of their ports,
+// so that it overlaps the rules of those protocols in their spaces.
+// The rule itself stands for the other protocols.
+func pieces(rs RuleSet, dims []Dimension, protocols []string) []piece {
+	wk := make([]piece, 0, len(rs))
+	for _, r := range rs {
+		for _, e := range r.expand(dims) {
+			wk = append(wk, piece{r: e, b: e.box(dims)})
 		}
-		if rsj.Tag < rsi.Tag {
-			return false
+		if !isAnyProtocol(r.Protocol) {
+			continue
 		}
 
-		if portfirst {
-			if rsi.Port.Start.Less(rsj.Port.Start) {
-				return true
+		for _, p := range protocols {
+			c := r
+			c.Protocol = p
+			if hasPorts(p) {
+				c.Port = AnyPort
+				c.RemotePort = rng.Range{}
 			}
-			if rsj.Port.Start.Less(rsi.Port.Start) {
-				return false
+			for _, e := range c.expand(dims) {
+				wk = append(wk, piece{r: e, b: e.box(dims), copied: true})
 			}
+		}
+	}
+	return wk
+}
 
-			if rsi.Port.End.Less(rsj.Port.End) {
-				return true
-			}
-			if rsj.Port.End.Less(rsi.Port.End) {
-				return false
-			}
+// anyProtocol returns wk in the spaces of protocol any,
+// to find the pieces overlapping across protocols by intersectingPairs.
+func anyProtocol(wk []piece) []piece {
+	result := make([]piece, len(wk))
+	for i, e := range wk {
+		e.r.Protocol = "any"
+		result[i] = e
+	}
+	return result
+}
 
-			if rsi.IP.Start.Less(rsj.IP.Start) {
-				return true
-			}
-			if rsj.IP.Start.Less(rsi.IP.Start) {
-				return false
+// subtract cuts each rule by the preceding rules of the opposite action.
+func subtract(wk []piece, dims []Dimension) []piece {
+	/*
+	 * r0  *--+     cutters of r2
+	 * r1  *--+
+	 * r2  <--+
+	 */
+
+	cutters := make([][]int, len(wk))
+	for _, p := range intersectingPairs(wk, func(i, k int) bool { return wk[i].r.Allow != wk[k].r.Allow }) {
+		i, k := p[0], p[1]
+		if k < i {
+			i, k = k, i
+		}
+		cutters[k] = append(cutters[k], i)
+	}
+
+	// pieces[i] are the remains of wk[i], already cut by its cutters
+	pieces := make([][]piece, len(wk))
+	for k := range wk {
+		sort.Ints(cutters[k])
+
+		var cc []piece
+		for _, i := range cutters[k] {
+			cc = append(cc, pieces[i]...)
+		}
+		pieces[k] = wk[k].minusAll(nil, cc, dims)
+	}
+
+	// A block of any cannot block the other protocols where an earlier rule allows some protocol,
+	// without blocking that one too. They are left unmatched there,
+	// though the block has cut the later allows of any above, as it still decides them.
+	spared := make([][]int, len(wk))
+	for _, p := range intersectingPairs(anyProtocol(wk), func(i, k int) bool {
+		i, k = min(i, k), max(i, k)
+		return wk[i].r.Allow && !wk[i].copied && !isAnyProtocol(wk[i].r.Protocol) &&
+			!wk[k].r.Allow && !wk[k].copied && isAnyProtocol(wk[k].r.Protocol)
+	}) {
+		i, k := min(p[0], p[1]), max(p[0], p[1])
+		spared[k] = append(spared[k], i)
+	}
+	for k := range wk {
+		if len(spared[k]) == 0 {
+			continue
+		}
+		sort.Ints(spared[k])
+
+		var cc []piece
+		for _, i := range spared[k] {
+			for _, c := range pieces[i] {
+				// any port of an allowed protocol spares all of the other protocols
+				c.r.Protocol = wk[k].r.Protocol
+				c.b = c.r.box(dims)
+				cc = append(cc, c)
 			}
+		}
+		var remains []piece
+		for _, e := range pieces[k] {
+			remains = e.minusAll(remains, cc, dims)
+		}
+		pieces[k] = remains
+	}
 
-			if rsi.IP.End.Less(rsj.IP.End) {
-				return true
+	result := make([]piece, 0, len(wk))
+	for _, pp := range pieces {
+		result = append(result, pp...)
+	}
+	return result
+}
+
+// minusAll appends the pieces of wkk outside cc to result, cutting them by cc in order.
+//
+// Each cutter only cuts the pieces it overlaps,
+// and each piece is passed only the rest of cc overlapping it,
+// so that many small cutters of a large rule cost far less than
+// cutting every piece by every cutter.
+func (wkk piece) minusAll(result []piece, cc []piece, dims []Dimension) []piece {
+	for n, c := range cc {
+		if !wkk.b.intersects(c.b) {
+			continue
+		}
+		rest := cc[n+1:]
+		for _, e := range wkk.minus(c, dims) {
+			var overlapping []piece
+			for _, o := range rest {
+				if e.b.intersects(o.b) {
+					overlapping = append(overlapping, o)
+				}
 			}
-			if rsj.IP.End.Less(rsi.IP.End) {
-				return false
+			result = e.minusAll(result, overlapping, dims)
+		}
+		return result
+	}
+	return append(result, wkk)
+}
+
+// minus returns the pieces of wkk outside wki.
+// Each piece is named after the original rules which cut it and still touch it.
+func (wkk piece) minus(wki piece, dims []Dimension) []piece {
+	if !wkk.b.intersects(wki.b) {
+		return []piece{wkk}
+	}
+
+	tmpbox := wkk.b.Minus(wki.b)
+	tmp := make([]piece, 0, len(tmpbox))
+	for _, e := range tmpbox {
+		var cutters []cut
+		for _, c := range wkk.cutters {
+			if e.touches(c.b) {
+				cutters = append(cutters, c)
 			}
+		}
+		// a slab around wki touches it
+		if wki.r.Original {
+			cutters = append(cutters, cut{tag: wki.r.Tag, b: wki.b})
+		}
+
+		r := wkk.r
+		r.Original = false
+		r.setBox(dims, e)
+		tmp = append(tmp, piece{r: r, b: e, cutters: cutters, copied: wkk.copied})
+	}
+	return tmp
+}
 
-		} else {
-			if rsi.IP.Start.Less(rsj.IP.Start) {
-				return true
+// dropCopies drops the copies of rules of protocol any (see pieces) decided by the rules themselves.
+// An allow of any allows every protocol wherever its copies allow one,
+// and a block of any blocks every protocol wherever it blocks the other ones.
+func dropCopies(wk []piece) []piece {
+	// the blocks of any overlapping each copied block
+	blocks := make([][]int, len(wk))
+	for _, p := range intersectingPairs(anyProtocol(wk), func(i, k int) bool {
+		if wk[k].copied {
+			i, k = k, i
+		}
+		return wk[i].copied && !wk[i].r.Allow && !wk[k].copied && !wk[k].r.Allow && isAnyProtocol(wk[k].r.Protocol)
+	}) {
+		c, o := p[0], p[1]
+		if wk[o].copied {
+			c, o = o, c
+		}
+		blocks[c] = append(blocks[c], o)
+	}
+
+	result := make([]piece, 0, len(wk))
+	for k, e := range wk {
+		if e.copied {
+			if e.r.Allow {
+				continue
 			}
-			if rsj.IP.Start.Less(rsi.IP.Start) {
-				return false
+			sort.Ints(blocks[k])
+			if len(minusAll([]Box{e.b}, wk, blocks[k])) == 0 {
+				continue
 			}
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// removeContained removes each rule contained in another rule of the same action and group.
+// Of equal rules, the first one remains.
+func removeContained(wk []piece) []piece {
+	removed := make([]bool, len(wk))
+	for _, p := range intersectingPairs(wk, func(i, k int) bool {
+		return wk[i].r.Allow == wk[k].r.Allow && wk[i].r.Group == wk[k].r.Group
+	}) {
+		i, k := p[0], p[1]
+		if wk[i].b.Equal(wk[k].b) {
+			removed[max(i, k)] = true
+		} else if wk[k].b.Contains(wk[i].b) {
+			removed[i] = true
+		} else if wk[i].b.Contains(wk[k].b) {
+			removed[k] = true
+		}
+	}
+
+	result := wk[:0]
+	for i, e := range wk {
+		if !removed[i] {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// joinOrder returns the order of dimensions to join, 2nd, 1st, 3rd, 4th, ...
+func joinOrder(n int) []int {
+	order := identity(n)
+	if n >= 2 {
+		order[0], order[1] = 1, 0
+	}
+	return order
+}
+
+func identity(n int) []int {
+	order := make([]int, n)
+	for d := range order {
+		order[d] = d
+	}
+	return order
+}
 
-			if rsi.IP.End.Less(rsj.IP.End) {
-				return true
+// join joins adjacent rules in the dimension d.
+// A joined rule takes the place and the attributes of the first one of its parts.
+func join(wk []piece, dims []Dimension, d int) []piece {
+	idx := groupBy(wk, d)
+
+	removed := make([]bool, len(wk))
+	for g := 0; g < len(idx); {
+		// a chain of adjacent rules
+		first, last := idx[g], idx[g]
+		h := g + 1
+		for ; h < len(idx); h++ {
+			prev, next := wk[idx[h-1]], wk[idx[h]]
+			if !sameGroup(prev, next, d) || !prev.b.joinable(next.b, d) {
+				break
 			}
-			if rsj.IP.End.Less(rsi.IP.End) {
-				return false
+			first = min(first, idx[h])
+			last = idx[h]
+		}
+
+		if h-g > 1 {
+			for _, i := range idx[g:h] {
+				if i != first {
+					wk[first].cutters = append(wk[first].cutters, wk[i].cutters...)
+					removed[i] = true
+				}
 			}
 
-			if rsi.Port.Start.Less(rsj.Port.Start) {
-				return true
+			r := rng.NewRange(wk[idx[g]].b[d].Start, wk[last].b[d].End)
+			wk[first].b = wk[first].b.with(d, r)
+			dims[d].SetRange(&wk[first].r, r)
+		}
+
+		g = h
+	}
+
+	return compact(wk, removed)
+}
+
+// Uniter is implemented by a Dimension in which a rule can have disjoint ranges,
+// such as ProfileDimension.
+type Uniter interface {
+	// Unite adds the values of a in the dimension to r.
+	Unite(r *Rule, a Rule)
+}
+
+// unite unites rules which differ only in the dimension d into the first one of them.
+//
+// The box of the united rule in d becomes the united range if it is,
+// or a negative key of the disjoint values, so that later joins tell the values apart.
+// Uniter dimensions are of rng.Int.
+func unite(wk []piece, d int, u Uniter) []piece {
+	idx := groupBy(wk, d)
+	keys := make(map[string]int)
+
+	removed := make([]bool, len(wk))
+	for g := 0; g < len(idx); {
+		first := idx[g]
+		h := g + 1
+		for ; h < len(idx) && sameGroup(wk[idx[g]], wk[idx[h]], d); h++ {
+			first = min(first, idx[h])
+		}
+
+		for _, i := range idx[g:h] {
+			if i != first {
+				u.Unite(&wk[first].r, wk[i].r)
+				wk[first].cutters = append(wk[first].cutters, wk[i].cutters...)
+				removed[i] = true
 			}
-			if rsj.Port.Start.Less(rsi.Port.Start) {
-				return false
+		}
+
+		if h-g > 1 {
+			rr := u.(Dimension).Ranges(wk[first].r)
+			if len(rr) == 1 {
+				wk[first].b = wk[first].b.with(d, rr[0])
+			} else {
+				s := fmt.Sprint(rr)
+				if _, found := keys[s]; !found {
+					keys[s] = -1 - len(keys)
+				}
+				wk[first].b = wk[first].b.with(d, rng.NewRange(rng.Int(keys[s]), rng.Int(keys[s])))
 			}
+		}
+
+		g = h
+	}
+
+	return compact(wk, removed)
+}
+
+// groupBy returns the indices of wk sorted so that
+// rules which differ only in the dimension d are consecutive,
+// ordered by the dimension d.
+func groupBy(wk []piece, d int) []int {
+	idx := identity(len(wk))
+	sort.SliceStable(idx, func(i, j int) bool {
+		a, b := wk[idx[i]], wk[idx[j]]
+
+		if c := compareSpace(a.r, b.r); c != 0 {
+			return c < 0
+		}
+		if a.r.Allow != b.r.Allow {
+			return !a.r.Allow
+		}
+		if a.r.Group != b.r.Group {
+			return a.r.Group < b.r.Group
+		}
 
-			if rsi.Port.End.Less(rsj.Port.End) {
-				return true
+		for dd := range a.b {
+			if dd == d {
+				continue
 			}
-			if rsj.Port.End.Less(rsi.Port.End) {
-				return false
+			if c := compareRange(a.b[dd], b.b[dd]); c != 0 {
+				return c < 0
 			}
+		}
+		return compareRange(a.b[d], b.b[d]) < 0
+	})
+	return idx
+}
+
+func sameGroup(a, b piece, d int) bool {
+	return a.r.sameSpace(b.r) && a.r.Allow == b.r.Allow && a.r.Group == b.r.Group && a.b.with(d, b.b[d]).Equal(b.b)
+}
+
+func compact(wk []piece, removed []bool) []piece {
+	result := wk[:0]
+	for i, e := range wk {
+		if !removed[i] {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func compareSpace(a, b Rule) int {
+	if a.Direction != b.Direction {
+		return strings.Compare(a.Direction, b.Direction)
+	}
+	if !strings.EqualFold(a.Protocol, b.Protocol) {
+		return strings.Compare(strings.ToLower(a.Protocol), strings.ToLower(b.Protocol))
+	}
+	return Family(a.IP.Start) - Family(b.IP.Start)
+}
 
+func compareRange(a, b rng.Range) int {
+	switch {
+	case a.Start.Less(b.Start):
+		return -1
+	case b.Start.Less(a.Start):
+		return 1
+	case a.End.Less(b.End):
+		return -1
+	case b.End.Less(a.End):
+		return 1
+	}
+	return 0
+}
+
+// Sort sorts rs by Dimensions(portfirst).
+func (rs *RuleSet) Sort(portfirst bool) {
+	dims := Dimensions(portfirst)
+
+	wk := make([]piece, 0, len(*rs))
+	for _, r := range *rs {
+		wk = append(wk, piece{r: r, b: r.box(dims)})
+	}
+	sortPieces(wk, identity(len(dims)))
+
+	for i, e := range wk {
+		(*rs)[i] = e.r
+	}
+}
+
+// sortPieces sorts wk by the space, the tag, and then by the dimensions in order.
+func sortPieces(wk []piece, order []int) {
+	sort.SliceStable(wk, func(i, j int) bool {
+		a, b := wk[i], wk[j]
+
+		if c := compareSpace(a.r, b.r); c != 0 {
+			return c < 0
 		}
 
+		if a.r.Tag != b.r.Tag {
+			return a.r.Tag < b.r.Tag
+		}
+
+		for _, d := range order {
+			if c := compareRange(a.b[d], b.b[d]); c != 0 {
+				return c < 0
+			}
+		}
 		return false
 	})
 }
@@ -1,6 +1,8 @@
 package wfw_test
 
 import (
+	"math/rand"
+	"strconv"
 	"testing"
 
 	"github.com/shu-go/gotwant"
@@ -17,7 +19,7 @@ func TestUnary(t *testing.T) {
 	}
 
 	rs := wfw.RuleSet{rule1}
-	rsrs := rs.Hoge(true)
+	rsrs := rs.Hoge(true, wfw.FirstMatchModel)
 	gotwant.Test(t, len(rsrs), 1)
 	gotwant.Test(t, rsrs[0], rule1)
 }
@@ -36,7 +38,7 @@ func TestNonIntersecting(t *testing.T) {
 	}
 
 	rs := wfw.RuleSet{rule1, rule2}
-	rsrs := rs.Hoge(true)
+	rsrs := rs.Hoge(true, wfw.FirstMatchModel)
 	gotwant.Test(t, len(rsrs), 2)
 	gotwant.Test(t, rsrs[0].Port, rng.NewRange(rng.Int(445), rng.Int(445)))
 	gotwant.Test(t, rsrs[0].IP, rng.NewRange(rng.IPv4{192, 168, 200, 1}, rng.IPv4{192, 168, 200, 255}))
@@ -59,7 +61,7 @@ func TestPort(t *testing.T) {
 	}
 
 	rs := wfw.RuleSet{rule1, rule0}
-	rsrs := rs.Hoge(true)
+	rsrs := rs.Hoge(true, wfw.FirstMatchModel)
 	gotwant.Test(t, len(rsrs), 3)
 	gotwant.Test(t, rsrs[0], wfw.Rule{
 		Allow:    true,
@@ -82,7 +84,7 @@ func TestPort(t *testing.T) {
 
 	t.Run("Reverse", func(t *testing.T) {
 		rs := wfw.RuleSet{rule0, rule1}
-		rsrs := rs.Hoge(true)
+		rsrs := rs.Hoge(true, wfw.FirstMatchModel)
 		gotwant.Test(t, len(rsrs), 1)
 		gotwant.Test(t, rsrs[0], rule0)
 	})
@@ -103,7 +105,7 @@ func TestIP(t *testing.T) {
 	}
 
 	rs := wfw.RuleSet{rule1, rule0}
-	rsrs := rs.Hoge(true)
+	rsrs := rs.Hoge(true, wfw.FirstMatchModel)
 	gotwant.Test(t, len(rsrs), 3)
 	gotwant.Test(t, rsrs[0], wfw.Rule{
 		Allow:    true,
@@ -126,7 +128,7 @@ func TestIP(t *testing.T) {
 
 	t.Run("Reverse", func(t *testing.T) {
 		rs := wfw.RuleSet{rule0, rule1}
-		rsrs := rs.Hoge(true)
+		rsrs := rs.Hoge(true, wfw.FirstMatchModel)
 		gotwant.Test(t, len(rsrs), 1)
 		gotwant.Test(t, rsrs[0], rule0)
 	})
@@ -147,7 +149,7 @@ func TestCorner(t *testing.T) {
 	}
 
 	rs := wfw.RuleSet{rule0, rule1}
-	rsrs := rs.Hoge(true)
+	rsrs := rs.Hoge(true, wfw.FirstMatchModel)
 	gotwant.Test(t, len(rsrs), 3)
 	gotwant.Test(t, rsrs[0], rule0)
 	gotwant.Test(t, rsrs[1], wfw.Rule{
@@ -163,3 +165,793 @@ func TestCorner(t *testing.T) {
 		IP:       rng.NewRange(rng.IPv4{192, 168, 200, 100}, rng.IPv4{192, 168, 211, 100}),
 	})
 }
+
+func TestIPv6(t *testing.T) {
+	rule0 := wfw.Rule{
+		Allow:    false,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(0), rng.Int(65535)),
+		IP:       rng.NewRange(wfw.NewIPv6("fd00::1"), wfw.NewIPv6("fd00::ffff")),
+		Tag:      1,
+	}
+	rule1 := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(0), rng.Int(65535)),
+		IP:       rng.NewRange(wfw.NewIPv6("fd00::100"), wfw.NewIPv6("fd00::100")),
+		Tag:      0,
+	}
+
+	rs := wfw.RuleSet{rule1, rule0}
+	rsrs := rs.Hoge(false, wfw.FirstMatchModel)
+	gotwant.Test(t, len(rsrs), 3)
+	gotwant.Test(t, rsrs[0].Allow, true)
+	gotwant.Test(t, rsrs[0].IP, rng.NewRange(wfw.NewIPv6("fd00::100"), wfw.NewIPv6("fd00::100")))
+	gotwant.Test(t, rsrs[1].Allow, false)
+	gotwant.Test(t, rsrs[1].IP, rng.NewRange(wfw.NewIPv6("fd00::1"), wfw.NewIPv6("fd00::ff")))
+	gotwant.Test(t, rsrs[2].Allow, false)
+	gotwant.Test(t, rsrs[2].IP, rng.NewRange(wfw.NewIPv6("fd00::101"), wfw.NewIPv6("fd00::ffff")))
+
+	t.Run("Boundary", func(t *testing.T) {
+		gotwant.Test(t, wfw.NewIPv6("fd00::ffff").Next(), wfw.NewIPv6("fd00::1:0"))
+		gotwant.Test(t, wfw.NewIPv6("fd00::1:0").Prev(), wfw.NewIPv6("fd00::ffff"))
+		gotwant.Test(t, wfw.NewIPv6("fd00::1:0").String(), "fd00::1:0")
+	})
+}
+
+func TestFamilies(t *testing.T) {
+	// an IPv6 rule never splits an IPv4 rule
+	rule0 := wfw.Rule{
+		Allow:    false,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(0), rng.Int(65535)),
+		IP:       rng.NewRange(rng.IPv4{0, 0, 0, 0}, rng.IPv4{255, 255, 255, 255}),
+		Tag:      1,
+	}
+	rule1 := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(443), rng.Int(443)),
+		IP:       rng.NewRange(wfw.NewIPv6("::"), wfw.NewIPv6("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")),
+		Tag:      0,
+	}
+
+	rs := wfw.RuleSet{rule1, rule0}
+	rsrs := rs.Hoge(false, wfw.FirstMatchModel)
+	gotwant.Test(t, len(rsrs), 2)
+	gotwant.Test(t, rsrs[0], rule0)
+	gotwant.Test(t, rsrs[1], rule1)
+}
+
+func TestDirection(t *testing.T) {
+	// an inbound rule never splits an outbound rule
+	rule0 := wfw.Rule{
+		Allow:     false,
+		Direction: "out",
+		Protocol:  "TCP",
+		Port:      rng.NewRange(rng.Int(0), rng.Int(65535)),
+		IP:        rng.NewRange(rng.IPv4{192, 168, 200, 1}, rng.IPv4{192, 168, 200, 255}),
+		Tag:       1,
+	}
+	rule1 := wfw.Rule{
+		Allow:     true,
+		Direction: "in",
+		Protocol:  "TCP",
+		Port:      rng.NewRange(rng.Int(445), rng.Int(445)),
+		IP:        rng.NewRange(rng.IPv4{192, 168, 200, 1}, rng.IPv4{192, 168, 200, 255}),
+		Tag:       0,
+	}
+
+	rs := wfw.RuleSet{rule1, rule0}
+	rsrs := rs.Hoge(false, wfw.FirstMatchModel)
+	gotwant.Test(t, len(rsrs), 2)
+	gotwant.Test(t, rsrs[0], rule1)
+	gotwant.Test(t, rsrs[1], rule0)
+
+	t.Run("Same", func(t *testing.T) {
+		rule1 := rule1
+		rule1.Direction = "out"
+
+		rs := wfw.RuleSet{rule1, rule0}
+		rsrs := rs.Hoge(false, wfw.FirstMatchModel)
+		gotwant.Test(t, len(rsrs), 3)
+	})
+}
+
+func TestProfile(t *testing.T) {
+	rule0 := wfw.Rule{
+		Allow:    false,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(0), rng.Int(65535)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 200, 1}, rng.IPv4{192, 168, 200, 255}),
+		Tag:      1,
+	}
+	rule1 := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Profile:  wfw.ProfileDomain,
+		Port:     rng.NewRange(rng.Int(3389), rng.Int(3389)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 200, 1}, rng.IPv4{192, 168, 200, 255}),
+		Original: true,
+		Tag:      0,
+	}
+
+	rs := wfw.RuleSet{rule1, rule0}
+	rsrs := rs.Hoge(false, wfw.FirstMatchModel)
+	gotwant.Test(t, len(rsrs), 4)
+	gotwant.Test(t, rsrs[0].Equal(rule1), true)
+	// protocols are case-insensitive
+	lower := rule1
+	lower.Protocol = "tcp"
+	gotwant.Test(t, rsrs[0].Equal(lower), true)
+	// rule0 is cut only around 3389
+	gotwant.Test(t, rsrs[1].Allow, false)
+	gotwant.Test(t, rsrs[1].Profile.Set(), wfw.ProfileAny)
+	gotwant.Test(t, rsrs[1].Port, rng.NewRange(rng.Int(0), rng.Int(3388)))
+	// 3389 is still blocked on the private and public profiles
+	gotwant.Test(t, rsrs[2].Allow, false)
+	gotwant.Test(t, rsrs[2].Profile, wfw.ProfilePrivate|wfw.ProfilePublic)
+	gotwant.Test(t, rsrs[2].Port, rng.NewRange(rng.Int(3389), rng.Int(3389)))
+	gotwant.Test(t, rsrs[2].Excepts.GetDefault(0, false), true)
+	gotwant.Test(t, rsrs[3].Allow, false)
+	gotwant.Test(t, rsrs[3].Profile.Set(), wfw.ProfileAny)
+	gotwant.Test(t, rsrs[3].Port, rng.NewRange(rng.Int(3390), rng.Int(65535)))
+
+	t.Run("Disjoint", func(t *testing.T) {
+		rule0 := rule0
+		rule0.Profile = wfw.ProfilePublic
+
+		rs := wfw.RuleSet{rule1, rule0}
+		rsrs := rs.Hoge(false, wfw.FirstMatchModel)
+		gotwant.Test(t, len(rsrs), 2)
+	})
+}
+
+func TestRemotePortLocalIP(t *testing.T) {
+	rule0 := wfw.Rule{
+		Allow:    false,
+		Protocol: "UDP",
+		Port:     rng.NewRange(rng.Int(0), rng.Int(65535)),
+		IP:       rng.NewRange(rng.IPv4{0, 0, 0, 0}, rng.IPv4{255, 255, 255, 255}),
+		Tag:      1,
+	}
+	rule1 := wfw.Rule{
+		Allow:      true,
+		Protocol:   "UDP",
+		Port:       rng.NewRange(rng.Int(0), rng.Int(65535)),
+		IP:         rng.NewRange(rng.IPv4{0, 0, 0, 0}, rng.IPv4{255, 255, 255, 255}),
+		RemotePort: rng.NewRange(rng.Int(53), rng.Int(53)),
+		LocalIP:    rng.NewRange(rng.IPv4{10, 0, 0, 1}, rng.IPv4{10, 0, 0, 1}),
+		Tag:        0,
+	}
+
+	rs := wfw.RuleSet{rule1, rule0}
+	rsrs := rs.Hoge(false, wfw.FirstMatchModel)
+	gotwant.Test(t, len(rsrs), 5)
+	gotwant.Test(t, rsrs[0], rule1)
+	for _, r := range rsrs[1:] {
+		gotwant.Test(t, r.Allow, false)
+		gotwant.Test(t, r.Port, rule0.Port)
+		gotwant.Test(t, r.IP, rule0.IP)
+	}
+	// other remote ports on any local IP, then 53 on the other local IPs
+	gotwant.Test(t, rsrs[1].RemotePort, rng.NewRange(rng.Int(0), rng.Int(52)))
+	gotwant.Test(t, rsrs[1].LocalIP, rng.Range{})
+	gotwant.Test(t, rsrs[2].RemotePort, rule1.RemotePort)
+	gotwant.Test(t, rsrs[2].LocalIP, rng.NewRange(rng.IPv4{0, 0, 0, 0}, rng.IPv4{10, 0, 0, 0}))
+	gotwant.Test(t, rsrs[3].RemotePort, rule1.RemotePort)
+	gotwant.Test(t, rsrs[3].LocalIP, rng.NewRange(rng.IPv4{10, 0, 0, 2}, rng.IPv4{255, 255, 255, 255}))
+	gotwant.Test(t, rsrs[4].RemotePort, rng.NewRange(rng.Int(54), rng.Int(65535)))
+	gotwant.Test(t, rsrs[4].LocalIP, rng.Range{})
+}
+
+func TestExcepts(t *testing.T) {
+	web := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(80), rng.Int(80)),
+		IP:       rng.NewRange(rng.IPv4{10, 0, 0, 0}, rng.IPv4{10, 255, 255, 255}),
+		Original: true,
+		Tag:      0,
+	}
+	rdp := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Profile:  wfw.ProfileDomain,
+		Port:     rng.NewRange(rng.Int(3389), rng.Int(3389)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 0}, rng.IPv4{192, 168, 255, 255}),
+		Original: true,
+		Tag:      1,
+	}
+	deny := wfw.Rule{
+		Allow:    false,
+		Protocol: "TCP",
+		Port:     wfw.AnyPort,
+		IP:       wfw.AnyIP(4),
+		Original: true,
+		Tag:      2,
+	}
+
+	rs := wfw.RuleSet{web, rdp, deny}
+	rsrs := rs.Hoge(false, wfw.FirstMatchModel)
+	gotwant.Test(t, wfw.Verify(rs, rsrs, wfw.Dimensions(false)) == nil, true)
+
+	// deny is cut only around web and rdp, and each piece excepts the rules it touches
+	want := []struct {
+		port, ip rng.Range
+		excepts  []int
+	}{
+		{rng.NewRange(rng.Int(0), rng.Int(79)), web.IP, []int{0}},
+		{rng.NewRange(rng.Int(0), rng.Int(3388)), rdp.IP, []int{1}},
+		{wfw.AnyPort, rng.NewRange(rng.IPv4{0, 0, 0, 0}, rng.IPv4{9, 255, 255, 255}), []int{0}},
+		{wfw.AnyPort, rng.NewRange(rng.IPv4{11, 0, 0, 0}, rng.IPv4{192, 167, 255, 255}), []int{0, 1}},
+		{wfw.AnyPort, rng.NewRange(rng.IPv4{192, 169, 0, 0}, rng.IPv4{255, 255, 255, 255}), []int{1}},
+		{rng.NewRange(rng.Int(81), rng.Int(65535)), web.IP, []int{0}},
+		{rdp.Port, rdp.IP, []int{1}},
+		{rng.NewRange(rng.Int(3390), rng.Int(65535)), rdp.IP, []int{1}},
+	}
+	gotwant.Test(t, len(rsrs), 2+len(want))
+	gotwant.Test(t, rsrs[0].Equal(web), true)
+	gotwant.Test(t, rsrs[1].Equal(rdp), true)
+	for i, w := range want {
+		r := rsrs[2+i]
+		gotwant.Test(t, r.Tag, deny.Tag)
+		gotwant.Test(t, r.Port, w.port)
+		gotwant.Test(t, r.IP, w.ip)
+		gotwant.Test(t, r.Excepts.Keys(), w.excepts)
+	}
+	// 3389 is blocked only on the profiles rdp does not allow
+	gotwant.Test(t, rsrs[8].Profile, wfw.ProfilePrivate|wfw.ProfilePublic)
+}
+
+func TestBox(t *testing.T) {
+	b := wfw.Box{
+		rng.NewRange(rng.Int(0), rng.Int(9)),
+		rng.NewRange(rng.Int(0), rng.Int(9)),
+		rng.NewRange(rng.Int(0), rng.Int(9)),
+	}
+	a := wfw.Box{
+		rng.NewRange(rng.Int(3), rng.Int(5)),
+		rng.NewRange(rng.Int(0), rng.Int(9)),
+		rng.NewRange(rng.Int(5), rng.Int(20)),
+	}
+
+	i, intersecting := b.Intersection(a)
+	gotwant.Test(t, intersecting, true)
+	gotwant.Test(t, i, wfw.Box{
+		rng.NewRange(rng.Int(3), rng.Int(5)),
+		rng.NewRange(rng.Int(0), rng.Int(9)),
+		rng.NewRange(rng.Int(5), rng.Int(9)),
+	})
+
+	// below and above a in the 1st dimension, and below a in the 3rd within a in the 1st
+	gotwant.Test(t, b.Minus(a), []wfw.Box{
+		{rng.NewRange(rng.Int(0), rng.Int(2)), b[1], b[2]},
+		{rng.NewRange(rng.Int(6), rng.Int(9)), b[1], b[2]},
+		{rng.NewRange(rng.Int(3), rng.Int(5)), b[1], rng.NewRange(rng.Int(0), rng.Int(4))},
+	})
+	for _, e := range b.Minus(a) {
+		gotwant.Test(t, b.Contains(e), true)
+		_, intersecting := e.Intersection(a)
+		gotwant.Test(t, intersecting, false)
+	}
+
+	t.Run("Disjoint", func(t *testing.T) {
+		a := wfw.Box{a[0], a[1], rng.NewRange(rng.Int(10), rng.Int(20))}
+		gotwant.Test(t, b.Minus(a), []wfw.Box{b})
+	})
+}
+
+// benchRules returns n rules like a blocklist import:
+// blocks of scattered IP ranges, with some allowed ports in between.
+func benchRules(n int) wfw.RuleSet {
+	rnd := rand.New(rand.NewSource(int64(n)))
+
+	rs := make(wfw.RuleSet, 0, n)
+	for i := 0; i < n; i++ {
+		a, b := rnd.Intn(256), rnd.Intn(256)
+		ip := rng.NewRange(rng.IPv4{a, b, 0, 0}, rng.IPv4{a, b, rnd.Intn(256), 255})
+
+		r := wfw.Rule{
+			Allow:    false,
+			Protocol: "TCP",
+			Port:     rng.NewRange(rng.Int(0), rng.Int(65535)),
+			IP:       ip,
+			Original: true,
+			Tag:      i,
+		}
+		if i%10 == 0 {
+			port := rnd.Intn(65536)
+			r.Allow = true
+			r.Port = rng.NewRange(rng.Int(port), rng.Int(port))
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// benchAllowlist returns n allowed ports of scattered IP ranges,
+// followed by one rule blocking all the rest.
+func benchAllowlist(n int) wfw.RuleSet {
+	rnd := rand.New(rand.NewSource(int64(n)))
+
+	rs := make(wfw.RuleSet, 0, n+1)
+	for i := 0; i < n; i++ {
+		a, b, c := rnd.Intn(256), rnd.Intn(256), rnd.Intn(256)
+		port := rnd.Intn(65536)
+		rs = append(rs, wfw.Rule{
+			Allow:    true,
+			Protocol: "TCP",
+			Port:     rng.NewRange(rng.Int(port), rng.Int(port)),
+			IP:       rng.NewRange(rng.IPv4{a, b, c, 0}, rng.IPv4{a, b, c, 255}),
+			Original: true,
+			Tag:      i,
+		})
+	}
+	rs = append(rs, wfw.Rule{
+		Allow:    false,
+		Protocol: "TCP",
+		Port:     wfw.AnyPort,
+		IP:       wfw.AnyIP(4),
+		Original: true,
+		Tag:      n,
+	})
+	return rs
+}
+
+var benchShapes = []struct {
+	name  string
+	rules func(n int) wfw.RuleSet
+}{
+	{"blocklist", benchRules},
+	{"allowlist", benchAllowlist},
+}
+
+func BenchmarkHoge(b *testing.B) {
+	for _, shape := range benchShapes {
+		for _, n := range []int{100, 1000, 10000} {
+			rs := shape.rules(n)
+			b.Run(shape.name+"/"+strconv.Itoa(n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					rs.Hoge(false, wfw.FirstMatchModel)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	for _, shape := range benchShapes {
+		for _, n := range []int{100, 1000, 10000} {
+			rs := shape.rules(n)
+			out := rs.Hoge(false, wfw.FirstMatchModel)
+			b.Run(shape.name+"/"+strconv.Itoa(n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					wfw.Verify(rs, out, wfw.Dimensions(false))
+				}
+			})
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	rule0 := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(445), rng.Int(445)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 200, 100}, rng.IPv4{192, 168, 200, 100}),
+		Original: true,
+		Tag:      0,
+	}
+	rule1 := wfw.Rule{
+		Allow:    false,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(0), rng.Int(65535)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 200, 1}, rng.IPv4{192, 168, 200, 255}),
+		Original: true,
+		Tag:      1,
+	}
+
+	rs := wfw.RuleSet{rule0, rule1}
+	for _, portfirst := range []bool{false, true} {
+		gotwant.Test(t, wfw.Verify(rs, rs.Hoge(portfirst, wfw.FirstMatchModel), wfw.Dimensions(portfirst)) == nil, true)
+	}
+
+	t.Run("Overlapping", func(t *testing.T) {
+		// the block wins over the allow
+		ce := wfw.Verify(rs, rs, wfw.Dimensions(false))
+		if ce == nil {
+			t.Fatal("no counterexample")
+		}
+		gotwant.Test(t, ce.Packet.Port, rng.NewRange(rng.Int(445), rng.Int(445)))
+		gotwant.Test(t, ce.Packet.IP, rng.NewRange(rng.IPv4{192, 168, 200, 100}, rng.IPv4{192, 168, 200, 100}))
+		gotwant.Test(t, ce.Want, wfw.Allowed)
+		gotwant.Test(t, ce.Got, wfw.Blocked)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		ce := wfw.Verify(rs, rs[:1], wfw.Dimensions(false))
+		if ce == nil {
+			t.Fatal("no counterexample")
+		}
+		gotwant.Test(t, ce.Want, wfw.Blocked)
+		gotwant.Test(t, ce.Got, wfw.NoMatch)
+	})
+
+	t.Run("Extra", func(t *testing.T) {
+		ce := wfw.Verify(wfw.RuleSet{}, rs[1:], wfw.Dimensions(false))
+		if ce == nil {
+			t.Fatal("no counterexample")
+		}
+		gotwant.Test(t, ce.Want, wfw.NoMatch)
+		gotwant.Test(t, ce.Got, wfw.Blocked)
+	})
+
+	t.Run("Any", func(t *testing.T) {
+		// any shadows TCP
+		anyRule := wfw.Rule{
+			Allow:    true,
+			Protocol: "any",
+			Port:     rng.NewRange(rng.Int(0), rng.Int(0)),
+			IP:       rule1.IP,
+			Original: true,
+			Tag:      0,
+		}
+		block := rule1
+		block.Port = rule0.Port
+		rs := wfw.RuleSet{anyRule, block}
+
+		ce := wfw.Verify(rs, rs, wfw.Dimensions(false))
+		if ce == nil {
+			t.Fatal("no counterexample")
+		}
+		gotwant.Test(t, ce.Packet.Protocol, "TCP")
+		gotwant.Test(t, ce.Packet.Port, rng.NewRange(rng.Int(445), rng.Int(445)))
+		gotwant.Test(t, ce.Want, wfw.Allowed)
+		gotwant.Test(t, ce.Got, wfw.Blocked)
+
+		rsrs := rs.Hoge(false, wfw.FirstMatchModel)
+		gotwant.Test(t, len(rsrs), 1)
+		gotwant.Test(t, rsrs[0].Protocol, "any")
+		gotwant.Test(t, wfw.Verify(rs, rsrs, wfw.Dimensions(false)) == nil, true)
+
+		// a block of any cannot spare the allowed TCP, so the other protocols are left unmatched there
+		rs = wfw.RuleSet{rule0, wfw.Rule{Allow: false, Protocol: "any", IP: rule1.IP, Original: true, Tag: 1}}
+		ce = wfw.Verify(rs, rs.Hoge(false, wfw.FirstMatchModel), wfw.Dimensions(false))
+		if ce == nil {
+			t.Fatal("no counterexample")
+		}
+		gotwant.Test(t, ce.Packet.Protocol, "any")
+		gotwant.Test(t, ce.Packet.IP, rule0.IP)
+		gotwant.Test(t, ce.Want, wfw.Blocked)
+		gotwant.Test(t, ce.Got, wfw.NoMatch)
+	})
+}
+
+func TestMatch(t *testing.T) {
+	rule0 := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Profile:  wfw.ProfileDomain,
+		Port:     rng.NewRange(rng.Int(3389), rng.Int(3389)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 101}, rng.IPv4{192, 168, 0, 101}),
+	}
+	rule1 := wfw.Rule{
+		Allow:    false,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(0), rng.Int(65535)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 1}, rng.IPv4{192, 168, 255, 255}),
+	}
+	rs := wfw.RuleSet{rule0, rule1}
+
+	packet := wfw.Rule{
+		Protocol: "tcp",
+		Profile:  wfw.ProfileDomain,
+		Port:     rng.NewRange(rng.Int(3389), rng.Int(3389)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 101}, rng.IPv4{192, 168, 0, 101}),
+	}
+	gotwant.Test(t, rs.FirstMatch(packet), 0)
+	gotwant.Test(t, rs.BlockWins(packet), 1)
+
+	packet.Profile = wfw.ProfilePublic
+	gotwant.Test(t, rs.FirstMatch(packet), 1)
+
+	packet.IP = rng.NewRange(rng.IPv4{10, 0, 0, 1}, rng.IPv4{10, 0, 0, 1})
+	gotwant.Test(t, rs.FirstMatch(packet), -1)
+	gotwant.Test(t, rs.BlockWins(packet), -1)
+}
+
+func TestLint(t *testing.T) {
+	allow := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(443), rng.Int(443)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 1}, rng.IPv4{192, 168, 255, 255}),
+		Tag:      0,
+	}
+	deny := wfw.Rule{
+		Allow:    false,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(0), rng.Int(65535)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 1}, rng.IPv4{192, 168, 255, 255}),
+		Tag:      1,
+	}
+	dead := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(3389), rng.Int(3389)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 101}, rng.IPv4{192, 168, 0, 101}),
+		Tag:      2,
+	}
+	redundant := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(443), rng.Int(443)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 101}, rng.IPv4{192, 168, 0, 101}),
+		Tag:      3,
+	}
+	other := wfw.Rule{
+		Allow:    true,
+		Protocol: "UDP",
+		Port:     rng.NewRange(rng.Int(53), rng.Int(53)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 101}, rng.IPv4{192, 168, 0, 101}),
+		Tag:      4,
+	}
+
+	rs := wfw.RuleSet{allow, deny, dead, redundant, other}
+	gotwant.Test(t, rs.Lint(), []wfw.Finding{
+		{Tag: 1, Shadowing: wfw.PartiallyShadowed, By: []int{0}},
+		{Tag: 2, Shadowing: wfw.Shadowed, By: []int{1}},
+		{Tag: 3, Shadowing: wfw.Redundant, By: []int{0}},
+	})
+
+	t.Run("Any", func(t *testing.T) {
+		// any matches the TCP and UDP packets, but ports mean nothing to it
+		anyRule := wfw.Rule{
+			Allow:    true,
+			Protocol: "any",
+			Port:     rng.NewRange(rng.Int(0), rng.Int(0)),
+			IP:       rng.NewRange(rng.IPv4{192, 168, 0, 101}, rng.IPv4{192, 168, 0, 101}),
+			Tag:      0,
+		}
+		block := dead
+		block.Allow = false
+		block.Tag = 1
+		other.Tag = 2
+
+		rs := wfw.RuleSet{anyRule, block, other}
+		gotwant.Test(t, rs.Lint(), []wfw.Finding{
+			{Tag: 1, Shadowing: wfw.Shadowed, By: []int{0}},
+			{Tag: 2, Shadowing: wfw.Redundant, By: []int{0}},
+		})
+
+		// the other protocols are still blocked
+		anyRule.Allow = false
+		block.Allow = true
+		rs = wfw.RuleSet{block, anyRule}
+		gotwant.Test(t, rs.Lint(), []wfw.Finding{
+			{Tag: 0, Shadowing: wfw.PartiallyShadowed, By: []int{1}},
+		})
+	})
+}
+
+func TestDiff(t *testing.T) {
+	allow := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(3389), rng.Int(3389)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 101}, rng.IPv4{192, 168, 0, 101}),
+		Tag:      0,
+	}
+	deny := wfw.Rule{
+		Allow:    false,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(0), rng.Int(65535)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 1}, rng.IPv4{192, 168, 255, 255}),
+		Tag:      1,
+	}
+
+	gotwant.Test(t, len(wfw.Diff(wfw.RuleSet{allow, deny}, wfw.RuleSet{allow, deny}, wfw.Dimensions(false))), 0)
+
+	// reordering
+	changes := wfw.Diff(wfw.RuleSet{allow, deny}, wfw.RuleSet{deny, allow}, wfw.Dimensions(false))
+	gotwant.Test(t, len(changes), 1)
+	gotwant.Test(t, changes[0].From, wfw.Allowed)
+	gotwant.Test(t, changes[0].To, wfw.Blocked)
+	gotwant.Test(t, changes[0].Region.Port, allow.Port)
+	gotwant.Test(t, changes[0].Region.IP, allow.IP)
+
+	// removal
+	changes = wfw.Diff(wfw.RuleSet{allow, deny}, wfw.RuleSet{allow}, wfw.Dimensions(false))
+	gotwant.Test(t, len(changes), 4) // around the allowed point
+	for _, c := range changes {
+		gotwant.Test(t, c.From, wfw.Blocked)
+		gotwant.Test(t, c.To, wfw.NoMatch)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	rule0 := wfw.Rule{
+		Allow:    true,
+		Group:    "web",
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(80), rng.Int(80)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 1}, rng.IPv4{192, 168, 255, 255}),
+		Tag:      0,
+	}
+	rule1 := wfw.Rule{
+		Allow:    true,
+		Group:    "mail",
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(81), rng.Int(81)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 1}, rng.IPv4{192, 168, 255, 255}),
+		Tag:      0,
+	}
+
+	rs := wfw.RuleSet{rule0, rule1}
+	gotwant.Test(t, len(rs.Hoge(false, wfw.FirstMatchModel)), 2)
+
+	rs[1].Group = "web"
+	gotwant.Test(t, len(rs.Hoge(false, wfw.FirstMatchModel)), 1)
+
+	t.Run("Contained", func(t *testing.T) {
+		rule1 := rule1
+		rule1.Port = rule0.Port
+
+		rs := wfw.RuleSet{rule0, rule1}
+		gotwant.Test(t, len(rs.Hoge(false, wfw.FirstMatchModel)), 2)
+	})
+}
+
+func TestModel(t *testing.T) {
+	allow := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(445), rng.Int(445)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 1}, rng.IPv4{192, 168, 0, 255}),
+	}
+	block := wfw.Rule{
+		Allow:    false,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(0), rng.Int(65535)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 100}, rng.IPv4{192, 168, 0, 100}),
+	}
+	rs := wfw.RuleSet{allow, block}
+
+	packet := wfw.Rule{
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(445), rng.Int(445)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 100}, rng.IPv4{192, 168, 0, 100}),
+	}
+	gotwant.Test(t, wfw.FirstMatchModel.Match(rs, packet), 0)
+	gotwant.Test(t, wfw.LastMatchModel.Match(rs, packet), 1)
+	gotwant.Test(t, wfw.BlockWinsModel.Match(rs, packet), 1)
+	gotwant.Test(t, wfw.LastMatchModel.Match(wfw.RuleSet{block, allow}, packet), 1)
+	gotwant.Test(t, wfw.BlockWinsModel.Match(wfw.RuleSet{block, allow}, packet), 0)
+
+	out := rs.Hoge(false, wfw.FirstMatchModel)
+	gotwant.Test(t, out[out.BlockWins(packet)].Allow, true)
+	out = rs.Hoge(false, wfw.LastMatchModel)
+	gotwant.Test(t, out[out.BlockWins(packet)].Allow, false)
+	out = rs.Hoge(false, wfw.BlockWinsModel)
+	gotwant.Test(t, out[out.BlockWins(packet)].Allow, false)
+
+	for _, name := range []string{"first-match", "last-match", "block-wins"} {
+		m, ok := wfw.ModelByName(name)
+		gotwant.Test(t, ok, true)
+		gotwant.Test(t, m.String(), name)
+	}
+
+	t.Run("Random", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+
+		decision := func(rs wfw.RuleSet, i int) wfw.Decision {
+			if i < 0 {
+				return wfw.NoMatch
+			}
+			return wfw.DecisionOf(rs[i])
+		}
+
+		// a packet of any is of a protocol of no rule
+		protocols := []string{"TCP", "UDP", "any"}
+
+		// Resolve leaves the protocols of no rule unmatched where a block of any cannot apply
+		inexpressible := func(rs wfw.RuleSet, want, got wfw.Decision, packet wfw.Rule) bool {
+			for _, r := range rs {
+				if r.Protocol == packet.Protocol && r.Protocol != "any" {
+					return false
+				}
+			}
+			return want == wfw.Blocked && got == wfw.NoMatch
+		}
+
+		for n := 0; n < 40; n++ {
+			var rs wfw.RuleSet
+			hasAny := false
+			for i := 0; i < 8; i++ {
+				p1, p2 := rnd.Intn(20), rnd.Intn(20)
+				a1, a2 := rnd.Intn(20), rnd.Intn(20)
+				r := wfw.Rule{
+					Allow:    rnd.Intn(2) == 0,
+					Protocol: protocols[rnd.Intn(len(protocols))],
+					Profile:  wfw.Profile(rnd.Intn(8)),
+					Port:     rng.NewRange(rng.Int(min(p1, p2)), rng.Int(max(p1, p2))),
+					IP:       rng.NewRange(rng.IPv4{10, 0, 0, min(a1, a2)}, rng.IPv4{10, 0, 0, max(a1, a2)}),
+					Original: true,
+					Tag:      i,
+				}
+				hasAny = hasAny || r.Protocol == "any"
+				rs = append(rs, r)
+			}
+
+			for _, m := range []wfw.Model{wfw.FirstMatchModel, wfw.LastMatchModel, wfw.BlockWinsModel} {
+				for _, portfirst := range []bool{false, true} {
+					out := rs.Hoge(portfirst, m)
+					if ce := wfw.Verify(m.Ordered(rs), out, wfw.Dimensions(portfirst)); ce != nil {
+						gotwant.Test(t, inexpressible(rs, ce.Want, ce.Got, ce.Packet), true)
+					}
+
+					for i := 0; i < 200; i++ {
+						port, a := rnd.Intn(21), rnd.Intn(21)
+						packet := wfw.Rule{
+							Protocol: protocols[rnd.Intn(len(protocols))],
+							Profile:  wfw.Profile(1 << rnd.Intn(3)),
+							Port:     rng.NewRange(rng.Int(port), rng.Int(port)),
+							IP:       rng.NewRange(rng.IPv4{10, 0, 0, a}, rng.IPv4{10, 0, 0, a}),
+						}
+
+						// the output decides in block-wins as the input does in m
+						want := decision(rs, m.Match(rs, packet))
+						got := decision(out, out.BlockWins(packet))
+						if !inexpressible(rs, want, got, packet) {
+							gotwant.Test(t, got, want)
+						}
+
+						// and in any model, but where an allow of any overlaps blocks of other protocols
+						if !hasAny {
+							gotwant.Test(t, decision(out, out.FirstMatch(packet)), want)
+							gotwant.Test(t, decision(out, out.LastMatch(packet)), want)
+						}
+					}
+				}
+			}
+		}
+	})
+}
+
+func TestGaps(t *testing.T) {
+	rule0 := wfw.Rule{
+		Allow:    true,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(445), rng.Int(445)),
+		IP:       rng.NewRange(rng.IPv4{192, 168, 0, 0}, rng.IPv4{192, 168, 0, 255}),
+	}
+	rule1 := wfw.Rule{
+		Allow:    false,
+		Protocol: "TCP",
+		Port:     rng.NewRange(rng.Int(0), rng.Int(1023)),
+		IP:       rng.NewRange(rng.IPv4{10, 0, 0, 0}, rng.IPv4{10, 255, 255, 255}),
+	}
+	rs := wfw.RuleSet{rule0, rule1}
+
+	universe := wfw.RuleSet{{
+		Allow:    false,
+		Protocol: "TCP",
+		Port:     wfw.AnyPort,
+		IP:       wfw.AnyIP(4),
+		Tag:      2,
+	}}
+
+	gaps := wfw.Gaps(rs, universe, wfw.Dimensions(false))
+	gotwant.Test(t, len(gaps), 6)
+	for _, g := range gaps {
+		gotwant.Test(t, g.Allow, false)
+		gotwant.Test(t, g.Tag, 2)
+	}
+
+	// the gaps and the rules cover the universe without overlapping
+	in := append(append(wfw.RuleSet{}, rs...), universe...)
+	out := append(append(wfw.RuleSet{}, rs...), gaps...)
+	gotwant.Test(t, wfw.Verify(in, out, wfw.Dimensions(false)) == nil, true)
+	gotwant.Test(t, len(wfw.Gaps(out, universe, wfw.Dimensions(false))), 0)
+}